@@ -37,18 +37,65 @@ func main() {
 	log.Println(" Storage:", cfg.Storage.Type)
 	log.Println("===================================")
 
+	topics := make(map[string]broker.TopicConfig, len(cfg.Broker.Topics))
+	for name, t := range cfg.Broker.Topics {
+		topics[name] = broker.TopicConfig{
+			MaxQueueSize:      t.QueueSize,
+			QueueType:         t.QueueType,
+			MaxDeliveries:     t.MaxDeliveries,
+			DeadLetterTopic:   t.DeadLetterTopic,
+			MessageTTL:        t.MessageTTL,
+			DeadLetterExpired: t.DeadLetterExpired,
+			DedupWindow:       t.DedupWindow,
+			Partitions:        t.Partitions,
+			Mode:              t.Mode,
+			Compact:           t.Compact,
+			MaxMessageSize:    t.MaxMessageSize,
+			Overflow:          t.Overflow,
+			MaxBacklog:        t.MaxBacklog,
+			BacklogOverflow:   t.BacklogOverflow,
+		}
+	}
+
+	dataDir := ""
+	if cfg.Storage.Type == "file" {
+		dataDir = cfg.Storage.Dir
+	}
+
 	// create broker
 	br := broker.NewBroker(broker.BrokerConfig{
-		MaxQueueSize:    cfg.Broker.DefaultQueueSize,
-		MessageTTL:      cfg.Broker.MessageTTL,
-		CleanupInterval: time.Minute,
+		MaxQueueSize:       cfg.Broker.DefaultQueueSize,
+		MessageTTL:         cfg.Broker.MessageTTL,
+		CleanupInterval:    time.Minute,
+		AckTimeout:         cfg.Broker.AckTimeout,
+		RedeliveryInterval: time.Second,
+		MaxDeliveries:      cfg.Broker.MaxDeliveries,
+		Topics:             topics,
+		DataDir:            dataDir,
+		DeadLetterExpired:  cfg.Broker.DeadLetterExpired,
+		DedupWindow:        cfg.Broker.DedupWindow,
+		LogRetention:       cfg.Storage.RetentionDuration,
+		LogMaxRetained:     cfg.Storage.MaxSize,
+		MaxMessageSize:     cfg.Broker.MaxMessageSize,
+		Overflow:           cfg.Broker.Overflow,
+		MaxBacklog:         cfg.Broker.MaxBacklog,
+		BacklogOverflow:    cfg.Broker.BacklogOverflow,
 	})
 
 	br.Start()
 
 	// create server
 	addr := cfg.Server.Host + ":" + strconv.Itoa(cfg.Server.Port)
-	srv, err := server.NewServer(addr, br)
+	srv, err := server.NewServer(addr, br, server.ConnectionConfig{
+		SendQueueSize:    cfg.Network.SendQueueSize,
+		SlowClientPolicy: cfg.Network.SlowClientPolicy,
+		SendTimeout:      cfg.Network.SendTimeout,
+		MaxFrameSize:     cfg.Network.MaxFrameSize,
+		MaxChunkBuffer:   cfg.Network.MaxChunkBuffer,
+
+		Compression:          cfg.Network.Compression,
+		CompressionThreshold: cfg.Network.CompressionThreshold,
+	})
 	if err != nil {
 		log.Fatal("failed to start server:", err)
 	}
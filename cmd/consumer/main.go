@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"queuego/internal/protocol"
 	"queuego/pkg/client"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -14,22 +15,41 @@ import (
 func main() {
 	addr := flag.String("addr", "127.0.0.1:9092", "broker address")
 	topic := flag.String("topic", "test", "topic name")
+	group := flag.String("group", "", "consumer group to join")
+	prefetch := flag.Int("prefetch", 0, "max unacknowledged messages, 0 = unlimited")
+	filter := flag.String("filter", "", "only receive messages matching this expression, e.g. \"region = 'eu' AND priority > 5\"")
+	offset := flag.String("offset", "", "where to start reading a log topic: earliest, latest, an offset or an RFC 3339 time")
+	clientID := flag.String("client-id", "", "durable client ID, messages published while disconnected are delivered on reconnect")
+	overflow := flag.String("overflow", "", "when this consumer falls behind: drop (miss messages) or spill (buffer them all), default per topic")
+	compression := flag.String("compression", "", "codecs to offer the broker for compressing large payloads, e.g. gzip,deflate")
 	flag.Parse()
 
 	cfg := client.ClientConfig{
 		RetryMax:      5,
 		RetryInterval: time.Second,
 		ConnTimeout:   5 * time.Second,
+		ClientID:      *clientID,
+	}
+	if *compression != "" {
+		cfg.Compression = strings.Split(*compression, ",")
 	}
 
 	consumer := client.NewConsumer(cfg)
+	consumer.Prefetch = *prefetch
+	consumer.Filter = *filter
+	consumer.Offset = *offset
+	consumer.Overflow = *overflow
 
 	if err := consumer.Connect(*addr); err != nil {
 		log.Fatal(err)
 	}
 	defer consumer.Disconnect()
 
-	err := consumer.Subscribe(*topic, func(cmd *protocol.Command) {
+	err := consumer.SubscribeGroup(*topic, *group, func(cmd *protocol.Command) {
+		if offset, ok := cmd.Headers[protocol.HeaderOffset]; ok {
+			log.Printf("received message on topic %s at offset %s: %s", cmd.Topic, offset, string(cmd.Payload))
+			return
+		}
 		log.Printf("received message on topic %s: %s", cmd.Topic, string(cmd.Payload))
 	})
 	if err != nil {
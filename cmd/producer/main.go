@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"log"
+	"queuego/internal/protocol"
 	"queuego/pkg/client"
+	"queuego/pkg/types"
+	"strings"
 	"time"
 )
 
@@ -12,6 +15,13 @@ func main() {
 	topic := flag.String("topic", "test", "topic name")
 	message := flag.String("message", "hello", "message payload")
 	count := flag.Int("count", 1, "number of messages")
+	priority := flag.Int("priority", 0, "message priority, higher is delivered first")
+	delay := flag.Duration("delay", 0, "delay before the message becomes visible to subscribers")
+	ttl := flag.Duration("ttl", 0, "message lifetime, 0 uses the topic default")
+	key := flag.String("key", "", "ordering key, messages with the same key stay in order")
+	retain := flag.Bool("retain", false, "keep the message as the topic's last value for new subscribers, an empty --message clears it")
+	batch := flag.Int("batch", 0, "send messages in batches of this size, one round trip per batch (0 = one at a time)")
+	compression := flag.String("compression", "", "codecs to offer the broker for compressing large payloads, e.g. gzip,deflate")
 	flag.Parse()
 
 	cfg := client.ClientConfig{
@@ -19,6 +29,9 @@ func main() {
 		RetryInterval: time.Second,
 		ConnTimeout:   5 * time.Second,
 	}
+	if *compression != "" {
+		cfg.Compression = strings.Split(*compression, ",")
+	}
 
 	producer := client.NewProducer(cfg)
 
@@ -27,13 +40,50 @@ func main() {
 	}
 	defer producer.Disconnect()
 
+	var pending []*types.Message
 	for i := 0; i < *count; i++ {
+		msg := &types.Message{
+			Topic:    *topic,
+			Payload:  []byte(*message),
+			Priority: *priority,
+			Key:      *key,
+			Retain:   *retain,
+		}
+		msg.Headers = map[string]string{}
+		if *delay > 0 {
+			msg.Headers[protocol.HeaderDelay] = delay.String()
+		}
+		if *ttl > 0 {
+			msg.Headers[protocol.HeaderTTL] = ttl.String()
+		}
+
+		if *batch > 0 {
+			pending = append(pending, msg)
+			if len(pending) == *batch || i == *count-1 {
+				publishBatch(producer, pending)
+				pending = nil
+			}
+			continue
+		}
+
 		// Publish waits for ACK internally
-		if err := producer.Publish(*topic, []byte(*message)); err != nil {
+		if err := producer.PublishMessage(msg); err != nil {
 			log.Fatal(err)
 		}
-
-		// No second ReadResponse here — Publish already consumed the ACK
 		log.Printf("message published and ACK received on topic %s", *topic)
 	}
 }
+
+// publishBatch sends msgs in one round trip and exits on the first failed message.
+func publishBatch(producer *client.Producer, msgs []*types.Message) {
+	errs, err := producer.PublishMessages(msgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("batch of %d messages published and ACK received", len(msgs))
+}
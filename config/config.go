@@ -4,6 +4,7 @@ import (
 	"errors"
 	"gopkg.in/yaml.v3"
 	"os"
+	"queuego/internal/protocol"
 	"strconv"
 	"time"
 )
@@ -21,19 +22,55 @@ type ServerConfig struct {
 }
 
 type BrokerConfig struct {
-	MaxTopics        int           `yaml:"maxTopics"`
-	DefaultQueueSize int           `yaml:"defaultQueueSize"`
-	MessageTTL       time.Duration `yaml:"messageTTL"`
+	MaxTopics         int                    `yaml:"maxTopics"`
+	DefaultQueueSize  int                    `yaml:"defaultQueueSize"`
+	MessageTTL        time.Duration          `yaml:"messageTTL"`
+	AckTimeout        time.Duration          `yaml:"ackTimeout"`
+	MaxDeliveries     int                    `yaml:"maxDeliveries"`
+	DeadLetterExpired bool                   `yaml:"deadLetterExpired"`
+	DedupWindow       time.Duration          `yaml:"dedupWindow"`
+	MaxMessageSize    int                    `yaml:"maxMessageSize"`  // bytes, 0 = unlimited
+	Overflow          string                 `yaml:"overflow"`        // drop | spill, for subscribers that fall behind
+	MaxBacklog        int                    `yaml:"maxBacklog"`      // messages kept for a detached durable subscriber, 0 = defaultQueueSize
+	BacklogOverflow   string                 `yaml:"backlogOverflow"` // drop | drop-oldest
+	Topics            map[string]TopicConfig `yaml:"topics"`
+}
+
+// TopicConfig overrides broker defaults for a single topic.
+type TopicConfig struct {
+	QueueSize         int           `yaml:"queueSize"`
+	QueueType         string        `yaml:"queueType"` // fifo | priority
+	MaxDeliveries     int           `yaml:"maxDeliveries"`
+	DeadLetterTopic   string        `yaml:"deadLetterTopic"`
+	MessageTTL        time.Duration `yaml:"messageTTL"`
+	DeadLetterExpired *bool         `yaml:"deadLetterExpired"` // unset = broker default
+	DedupWindow       time.Duration `yaml:"dedupWindow"`
+	Partitions        int           `yaml:"partitions"`
+	Mode              string        `yaml:"mode"` // queue | log
+	Compact           bool          `yaml:"compact"`
+	MaxMessageSize    int           `yaml:"maxMessageSize"`
+	Overflow          string        `yaml:"overflow"` // drop | spill
+	MaxBacklog        int           `yaml:"maxBacklog"`
+	BacklogOverflow   string        `yaml:"backlogOverflow"` // drop | drop-oldest
 }
 
 type NetworkConfig struct {
 	ReadTimeout       time.Duration `yaml:"readTimeout"`
 	WriteTimeout      time.Duration `yaml:"writeTimeout"`
 	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+	SendQueueSize     int           `yaml:"sendQueueSize"`
+	SlowClientPolicy  string        `yaml:"slowClientPolicy"`
+	SendTimeout       time.Duration `yaml:"sendTimeout"`
+	MaxFrameSize      int           `yaml:"maxFrameSize"`   // bytes, larger messages are sent in chunks
+	MaxChunkBuffer    int           `yaml:"maxChunkBuffer"` // bytes of partially received chunked messages per connection
+
+	Compression          []string `yaml:"compression"` // codecs clients may negotiate, e.g. gzip, deflate
+	CompressionThreshold int      `yaml:"compressionThreshold"`
 }
 
 type StorageConfig struct {
 	Type              string        `yaml:"type"`
+	Dir               string        `yaml:"dir"`
 	MaxSize           int           `yaml:"maxSize"`
 	RetentionDuration time.Duration `yaml:"retentionDuration"`
 }
@@ -49,14 +86,27 @@ func New() *Config {
 			MaxTopics:        1000,
 			DefaultQueueSize: 1000,
 			MessageTTL:       time.Hour,
+			AckTimeout:       30 * time.Second,
+			MaxDeliveries:    10,
+			DedupWindow:      2 * time.Minute,
+			MaxMessageSize:   64 * 1024 * 1024,
 		},
 		Network: NetworkConfig{
 			ReadTimeout:       30 * time.Second,
 			WriteTimeout:      30 * time.Second,
 			HeartbeatInterval: 10 * time.Second,
+			SendQueueSize:     100,
+			SlowClientPolicy:  "block",
+			SendTimeout:       5 * time.Second,
+			MaxFrameSize:      10 * 1024 * 1024,
+			MaxChunkBuffer:    64 * 1024 * 1024,
+
+			Compression:          []string{"gzip", "deflate"},
+			CompressionThreshold: 1024,
 		},
 		Storage: StorageConfig{
 			Type:              "memory",
+			Dir:               "data",
 			MaxSize:           100_000,
 			RetentionDuration: 24 * time.Hour,
 		},
@@ -88,9 +138,23 @@ func (c *Config) LoadFromEnv() {
 		}
 	}
 
+	if v := os.Getenv("QUEUEGO_ACK_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.Broker.AckTimeout = d
+		}
+	}
+
+	if v := os.Getenv("QUEUEGO_SLOW_CLIENT_POLICY"); v != "" {
+		c.Network.SlowClientPolicy = v
+	}
+
 	if v := os.Getenv("QUEUEGO_STORAGE_TYPE"); v != "" {
 		c.Storage.Type = v
 	}
+
+	if v := os.Getenv("QUEUEGO_STORAGE_DIR"); v != "" {
+		c.Storage.Dir = v
+	}
 }
 func (c *Config) Validate() error {
 	if c.Server.Port <= 0 || c.Server.Port > 65535 {
@@ -102,8 +166,87 @@ func (c *Config) Validate() error {
 	if c.Broker.DefaultQueueSize <= 0 {
 		return errors.New("defaultQueueSize must be > 0")
 	}
+	if c.Broker.AckTimeout <= 0 {
+		return errors.New("ackTimeout must be > 0")
+	}
+	if c.Network.SendQueueSize <= 0 {
+		return errors.New("sendQueueSize must be > 0")
+	}
+	switch c.Network.SlowClientPolicy {
+	case "block", "disconnect", "drop":
+	default:
+		return errors.New("slowClientPolicy must be block, disconnect or drop")
+	}
+	for _, name := range c.Network.Compression {
+		if _, ok := protocol.LookupCodec(name); !ok {
+			return errors.New("compression: unknown codec " + name)
+		}
+	}
+	if c.Network.MaxFrameSize <= 0 {
+		return errors.New("maxFrameSize must be > 0")
+	}
+	if c.Network.MaxChunkBuffer <= 0 {
+		return errors.New("maxChunkBuffer must be > 0")
+	}
+	if c.Broker.Overflow != "" && c.Broker.Overflow != "drop" && c.Broker.Overflow != "spill" {
+		return errors.New("overflow must be drop or spill")
+	}
+	if c.Broker.BacklogOverflow != "" && c.Broker.BacklogOverflow != "drop" && c.Broker.BacklogOverflow != "drop-oldest" {
+		return errors.New("backlogOverflow must be drop or drop-oldest")
+	}
+	if c.Broker.MaxBacklog < 0 {
+		return errors.New("maxBacklog must be >= 0")
+	}
+	if c.Broker.MaxMessageSize < 0 {
+		return errors.New("maxMessageSize must be >= 0")
+	}
+	// a limit within one frame would leave no room for chunked messages
+	if c.Broker.MaxMessageSize > 0 && c.Broker.MaxMessageSize <= c.Network.MaxFrameSize {
+		return errors.New("maxMessageSize must be 0 or > maxFrameSize")
+	}
+	if c.Network.CompressionThreshold < 0 {
+		return errors.New("compressionThreshold must be >= 0")
+	}
+	if c.Broker.MaxDeliveries < 0 {
+		return errors.New("maxDeliveries must be >= 0")
+	}
+	if c.Broker.DedupWindow < 0 {
+		return errors.New("dedupWindow must be >= 0")
+	}
+	for name, t := range c.Broker.Topics {
+		if t.QueueType != "" && t.QueueType != "fifo" && t.QueueType != "priority" {
+			return errors.New("topic " + name + ": queueType must be fifo or priority")
+		}
+		if t.Partitions < 0 {
+			return errors.New("topic " + name + ": partitions must be >= 0")
+		}
+		if t.Overflow != "" && t.Overflow != "drop" && t.Overflow != "spill" {
+			return errors.New("topic " + name + ": overflow must be drop or spill")
+		}
+		if t.BacklogOverflow != "" && t.BacklogOverflow != "drop" && t.BacklogOverflow != "drop-oldest" {
+			return errors.New("topic " + name + ": backlogOverflow must be drop or drop-oldest")
+		}
+		if t.MaxBacklog < 0 {
+			return errors.New("topic " + name + ": maxBacklog must be >= 0")
+		}
+		if t.MaxMessageSize < 0 {
+			return errors.New("topic " + name + ": maxMessageSize must be >= 0")
+		}
+		if t.MaxMessageSize > 0 && t.MaxMessageSize <= c.Network.MaxFrameSize {
+			return errors.New("topic " + name + ": maxMessageSize must be 0 or > maxFrameSize")
+		}
+		if t.Mode != "" && t.Mode != "queue" && t.Mode != "log" {
+			return errors.New("topic " + name + ": mode must be queue or log")
+		}
+		if t.Compact && t.Mode != "log" {
+			return errors.New("topic " + name + ": compact requires mode log")
+		}
+	}
 	if c.Storage.Type != "memory" && c.Storage.Type != "file" {
 		return errors.New("storage.type must be memory or file")
 	}
+	if c.Storage.Type == "file" && c.Storage.Dir == "" {
+		return errors.New("storage.dir is required for file storage")
+	}
 	return nil
 }
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+// BenchmarkPublishToDeliver measures the time from Publish to the message
+// reaching an idle subscriber's channel.
+func BenchmarkPublishToDeliver(b *testing.B) {
+	br := NewBroker(BrokerConfig{CleanupInterval: time.Minute, AckTimeout: time.Minute, RedeliveryInterval: time.Minute})
+	br.Start()
+	defer br.Stop()
+	sub, err := br.Subscribe("events", "bench", SubscribeOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var total time.Duration
+	for i := 0; i < b.N; i++ {
+		// let the distributor go back to waiting on an empty queue
+		time.Sleep(100 * time.Microsecond)
+		published := time.Now()
+		if err := br.Publish("events", &types.Message{Topic: "events", Payload: []byte("x")}); err != nil {
+			b.Fatal(err)
+		}
+		msg := <-sub.MessageChannel
+		total += time.Since(published)
+		br.Ack("events", sub.ID, msg.ID)
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "latency-ns/op")
+}
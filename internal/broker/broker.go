@@ -2,46 +2,108 @@ package broker
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"queuego/internal/storage"
 	"queuego/pkg/types"
+	"strings"
 	"sync"
 	"time"
 )
 
 type BrokerConfig struct {
-	MaxQueueSize    int
-	MessageTTL      time.Duration
-	CleanupInterval time.Duration
+	MaxQueueSize       int
+	MessageTTL         time.Duration
+	CleanupInterval    time.Duration
+	AckTimeout         time.Duration // how long a delivered message may stay unacknowledged
+	RedeliveryInterval time.Duration // how often ack deadlines are checked
+	MaxDeliveries      int           // default delivery attempts before dead-lettering, 0 = unlimited
+	Topics             map[string]TopicConfig
+	DataDir            string        // enables file persistence when set, e.g. for scheduled messages
+	DeadLetterExpired  bool          // default for routing expired messages to dead-letter topics
+	DedupWindow        time.Duration // default window for dropping republished message IDs, 0 = off
+	LogRetention       time.Duration // default age after which log topics drop messages, 0 = never
+	LogMaxRetained     int           // default max messages kept by a log topic, 0 = unlimited
+	MaxMessageSize     int           // default max payload bytes of a published message, 0 = unlimited
+	Overflow           string        // default policy of subscribers that fall behind, OverflowDrop if empty
+	MaxBacklog         int           // default max messages kept for a detached durable subscriber, 0 = MaxQueueSize
+	BacklogOverflow    string        // default policy of a full backlog, OverflowDrop if empty
 }
 
 type Broker struct {
 	Topics map[string]*Topic
 	Config BrokerConfig
 	mu     sync.RWMutex
+	txMu   sync.RWMutex // held for reading while publishing, for writing while committing a transaction
 
 	// metrics
 	TotalMessages       int
 	ActiveSubscriptions int
 
+	wildcards   map[string]*wildcardSubscription // subscription ID -> pattern subscription
+	scheduler   *scheduler
+	retained    *retainedStore
 	stopCleanup chan struct{}
 }
 
 // NewBroker initializes a broker with the given config.
 func NewBroker(config BrokerConfig) *Broker {
-	return &Broker{
+	b := &Broker{
 		Topics:      make(map[string]*Topic),
 		Config:      config,
+		wildcards:   make(map[string]*wildcardSubscription),
 		stopCleanup: make(chan struct{}),
 	}
+
+	var store, retainedStore *storage.FileStorage
+	if config.DataDir != "" {
+		var err error
+		store, err = storage.NewFileStorage(filepath.Join(config.DataDir, "scheduled"), 0)
+		if err != nil {
+			log.Printf("scheduled message storage unavailable, keeping them in memory: %v", err)
+			store = nil
+		}
+		retainedStore, err = storage.NewFileStorage(filepath.Join(config.DataDir, "retained"), 0)
+		if err != nil {
+			log.Printf("retained message storage unavailable, keeping them in memory: %v", err)
+			retainedStore = nil
+		}
+	}
+	b.scheduler = newScheduler(store, func(msg *types.Message) error {
+		// the inbox may have gone away while the message was waiting
+		if _, err := b.topicFor(msg.Topic); err != nil {
+			return err
+		}
+		return b.publish(msg.Topic, msg)
+	})
+	b.retained = newRetainedStore(retainedStore)
+	return b
 }
 
-// Start begins broker operations and starts cleanup goroutine.
+// Start begins broker operations and starts cleanup, redelivery and scheduling goroutines.
 func (b *Broker) Start() {
+	if err := b.scheduler.load(); err != nil {
+		log.Printf("restoring scheduled messages failed: %v", err)
+	}
+	if err := b.retained.load(); err != nil {
+		log.Printf("restoring retained messages failed: %v", err)
+	}
+	b.mu.RLock()
+	for name, topic := range b.Topics {
+		topic.setRetained(b.retained.get(name))
+	}
+	b.mu.RUnlock()
+
 	go b.cleanupLoop()
+	go b.redeliveryLoop()
+	go b.scheduler.run()
 }
 
 // Stop gracefully shuts down the broker.
 func (b *Broker) Stop() {
 	close(b.stopCleanup)
+	close(b.scheduler.stop)
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -58,11 +120,32 @@ func (b *Broker) CreateTopic(name string) error {
 	if _, exists := b.Topics[name]; exists {
 		return errors.New("topic already exists")
 	}
+	if IsWildcard(name) {
+		return errWildcardTopic
+	}
 
-	b.Topics[name] = NewTopic(name, b.Config.MaxQueueSize)
+	b.addTopic(name)
 	return nil
 }
 
+// addTopic creates a topic and attaches the wildcard subscriptions matching it. callers hold b.mu.
+func (b *Broker) addTopic(name string) *Topic {
+	topic := NewTopic(name, b.topicConfig(name))
+	topic.retained = b.retained.get(name)
+	b.Topics[name] = topic
+	if topic.log != nil && b.Config.DataDir != "" {
+		b.restoreLog(topic)
+	}
+	for _, w := range b.wildcards {
+		if b.wildcardMatch(w.head.Topic, name) {
+			if err := w.attach(topic, b.Config.AckTimeout); err != nil {
+				log.Printf("topic %s: wildcard subscription %s not attached: %v", name, w.head.ID, err)
+			}
+		}
+	}
+	return topic
+}
+
 // DeleteTopic deletes a topic and cleans up subscriptions.
 func (b *Broker) DeleteTopic(name string) error {
 	b.mu.Lock()
@@ -71,11 +154,101 @@ func (b *Broker) DeleteTopic(name string) error {
 	if topic, exists := b.Topics[name]; exists {
 		topic.Close()
 		delete(b.Topics, name)
+		if err := b.retained.clear(name); err != nil {
+			log.Printf("topic %s: clearing retained message failed: %v", name, err)
+		}
+		for _, w := range b.wildcards {
+			delete(w.topics, name)
+		}
 		return nil
 	}
 	return errors.New("topic not found")
 }
 
+// removeUnused deletes a topic a rejected commit created, unless it is no longer the
+// same topic or has messages or subscribers of its own. wildcard subscriptions that
+// attached to it meanwhile let it go, and its retained value stays stored.
+func (b *Broker) removeUnused(topic *Topic) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Topics[topic.Name] != topic || topic.Len() > 0 {
+		return
+	}
+	topic.mu.RLock()
+	for _, sub := range topic.Subscriptions {
+		if !sub.sharedChannel {
+			topic.mu.RUnlock()
+			return
+		}
+	}
+	topic.mu.RUnlock()
+
+	topic.Close()
+	delete(b.Topics, topic.Name)
+	for _, w := range b.wildcards {
+		delete(w.topics, topic.Name)
+	}
+}
+
+// restoreLog persists a log topic under the data directory and reloads the messages
+// it retained before a restart. compacted topics use keyed storage.
+func (b *Broker) restoreLog(topic *Topic) {
+	open := storage.NewFileStorage
+	if topic.Config.Compact {
+		open = storage.NewKeyedFileStorage
+	}
+	store, err := open(filepath.Join(b.Config.DataDir, "logs", topic.Name), 0)
+	if err == nil {
+		err = topic.log.restore(store)
+	}
+	if err != nil {
+		log.Printf("topic %s: log storage unavailable, keeping messages in memory: %v", topic.Name, err)
+		return
+	}
+	if n := topic.log.len(); n > 0 {
+		log.Printf("topic %s: restored %d log messages", topic.Name, n)
+	}
+}
+
+// inboxPrefix starts the names of the temporary reply topics created by CreateInbox.
+const inboxPrefix = "_inbox."
+
+// CreateInbox creates a temporary topic for replies to the given owner and returns its name.
+// inboxes are never matched by wildcard subscriptions; the owner deletes them with DeleteTopic.
+func (b *Broker) CreateInbox(owner string) string {
+	name := inboxPrefix + newMessageID()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Topics[name] = NewTopic(name, b.topicConfig(name))
+	log.Printf("inbox %s created for %s", name, owner)
+	return name
+}
+
+// wildcardMatch reports whether a wildcard subscription to pattern follows the topic name.
+// inboxes and dead-letter topics are left out, so failures of a matched topic are not
+// delivered to the same subscriber again, and again from the dead-letter topic's own
+// dead-letter topic. callers hold b.mu.
+func (b *Broker) wildcardMatch(pattern, name string) bool {
+	if strings.HasPrefix(name, inboxPrefix) || b.isDeadLetterTopic(name) {
+		return false
+	}
+	return MatchTopic(pattern, name)
+}
+
+// isDeadLetterTopic reports whether name receives the dead letters of other topics,
+// by default or as configured.
+func (b *Broker) isDeadLetterTopic(name string) bool {
+	if strings.HasSuffix(name, ".dlq") {
+		return true
+	}
+	for _, cfg := range b.Config.Topics {
+		if cfg.DeadLetterTopic == name {
+			return true
+		}
+	}
+	return false
+}
+
 // GetTopic returns a topic by name.
 func (b *Broker) GetTopic(name string) (*Topic, error) {
 	b.mu.RLock()
@@ -87,38 +260,285 @@ func (b *Broker) GetTopic(name string) (*Topic, error) {
 	return nil, errors.New("topic not found")
 }
 
-// Publish adds a message to a topic, creating the topic if necessary.
-func (b *Broker) Publish(topicName string, msg *types.Message) error {
+// MaxMessageSize returns the max payload bytes of a message published to topicName,
+// 0 = unlimited.
+func (b *Broker) MaxMessageSize(topicName string) int {
+	if topic, err := b.GetTopic(topicName); err == nil {
+		return topic.Config.MaxMessageSize
+	}
+	return b.topicConfig(topicName).MaxMessageSize
+}
+
+// IsLogTopic reports whether name is an existing log topic.
+func (b *Broker) IsLogTopic(name string) bool {
+	topic, err := b.GetTopic(name)
+	return err == nil && topic.log != nil
+}
+
+// errNoInbox is returned for messages to an inbox that was deleted or never created.
+var errNoInbox = errors.New("inbox does not exist")
+
+// topicFor returns the topic a client publishes to, creating it unless it is an
+// inbox: replies to a requester that went away must not recreate its inbox.
+func (b *Broker) topicFor(name string) (*Topic, error) {
+	if !strings.HasPrefix(name, inboxPrefix) {
+		return b.getOrCreateTopic(name), nil
+	}
+	topic, err := b.GetTopic(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errNoInbox, name)
+	}
+	return topic, nil
+}
+
+// getOrCreateTopic returns the named topic, creating it with its configured settings.
+func (b *Broker) getOrCreateTopic(name string) *Topic {
 	b.mu.Lock()
-	topic, exists := b.Topics[topicName]
+	defer b.mu.Unlock()
+
+	topic, exists := b.Topics[name]
 	if !exists {
-		topic = NewTopic(topicName, b.Config.MaxQueueSize)
-		b.Topics[topicName] = topic
+		topic = b.addTopic(name)
+	}
+	return topic
+}
+
+// topicConfig merges the per-topic overrides for name with the broker defaults.
+func (b *Broker) topicConfig(name string) TopicConfig {
+	cfg := b.Config.Topics[name]
+	if cfg.MaxQueueSize <= 0 {
+		cfg.MaxQueueSize = b.Config.MaxQueueSize
+	}
+	if cfg.QueueType == "" {
+		cfg.QueueType = QueueFIFO
+	}
+	if cfg.MaxDeliveries == 0 {
+		cfg.MaxDeliveries = b.Config.MaxDeliveries
+	}
+	if cfg.MessageTTL == 0 {
+		cfg.MessageTTL = b.Config.MessageTTL
+	}
+	if cfg.DeadLetterExpired == nil {
+		deadLetter := b.Config.DeadLetterExpired
+		cfg.DeadLetterExpired = &deadLetter
+	}
+	if cfg.DeadLetterTopic == "" {
+		cfg.DeadLetterTopic = name + ".dlq"
+	}
+	if cfg.DedupWindow == 0 {
+		cfg.DedupWindow = b.Config.DedupWindow
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ModeQueue
+	}
+	if cfg.Retention == 0 {
+		cfg.Retention = b.Config.LogRetention
+	}
+	if cfg.MaxRetained == 0 {
+		cfg.MaxRetained = b.Config.LogMaxRetained
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = b.Config.MaxMessageSize
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = b.Config.Overflow
+	}
+	if cfg.Overflow == "" {
+		cfg.Overflow = OverflowDrop
+	}
+	if cfg.MaxBacklog == 0 {
+		cfg.MaxBacklog = b.Config.MaxBacklog
+	}
+	if cfg.BacklogOverflow == "" {
+		cfg.BacklogOverflow = b.Config.BacklogOverflow
+	}
+	if cfg.BacklogOverflow == "" {
+		cfg.BacklogOverflow = OverflowDrop
+	}
+	return cfg
+}
+
+// Publish adds a message to a topic, creating the topic if necessary.
+// a producer-assigned ID already seen within the topic's dedup window yields ErrDuplicate.
+func (b *Broker) Publish(topicName string, msg *types.Message) error {
+	b.txMu.RLock()
+	defer b.txMu.RUnlock()
+	return b.accept(topicName, msg)
+}
+
+// PublishBatch publishes msgs, each to its Topic field, in one go and returns
+// the outcome of every message, as Publish would have. a failed message does
+// not stop the rest of the batch.
+func (b *Broker) PublishBatch(msgs []*types.Message) []error {
+	b.txMu.RLock()
+	defer b.txMu.RUnlock()
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = b.accept(msg.Topic, msg)
+	}
+	return errs
+}
+
+// accept checks and deduplicates a message published by a client, then queues it.
+// callers hold b.txMu for reading.
+func (b *Broker) accept(topicName string, msg *types.Message) error {
+	if IsWildcard(topicName) {
+		return errWildcardTopic
+	}
+	topic, err := b.topicFor(topicName)
+	if err != nil {
+		return err
+	}
+	if err := topic.checkSize(msg); err != nil {
+		return err
+	}
+	if msg.ID == "" {
+		return b.enqueue(topicName, msg)
+	}
+	if !topic.dedup.record(msg.ID, time.Now()) {
+		return ErrDuplicate
+	}
+	if err := b.enqueue(topicName, msg); err != nil {
+		topic.dedup.forget(msg.ID)
+		return err
+	}
+	return nil
+}
+
+// publish adds a message to a topic without deduplication, for messages the broker moves itself.
+func (b *Broker) publish(topicName string, msg *types.Message) error {
+	b.txMu.RLock()
+	defer b.txMu.RUnlock()
+	return b.enqueue(topicName, msg)
+}
+
+// enqueue adds a message to a topic. a retained message also becomes the topic's
+// last value, unless its payload is empty, which clears the retained value instead
+// of publishing anything. callers hold b.txMu for reading.
+func (b *Broker) enqueue(topicName string, msg *types.Message) error {
+	if msg.Retain && len(msg.Payload) == 0 {
+		return b.ClearRetained(topicName)
+	}
+	if msg.ID == "" {
+		msg.ID = newMessageID()
 	}
-	b.mu.Unlock()
 
+	topic := b.getOrCreateTopic(topicName)
 	if err := topic.Publish(msg); err != nil {
 		return err
 	}
+	b.published(topic, msg)
+	return nil
+}
+
+// published records a message that was added to topic, making it the topic's
+// retained value if it asked for it.
+func (b *Broker) published(topic *Topic, msg *types.Message) {
+	if msg.Retain {
+		if err := b.retained.set(msg); err != nil {
+			log.Printf("topic %s: persisting retained message %s failed: %v", topic.Name, msg.ID, err)
+		}
+		topic.setRetained(msg)
+	}
 
 	b.mu.Lock()
 	b.TotalMessages++
 	b.mu.Unlock()
+}
+
+// ClearRetained removes the retained message of a topic.
+func (b *Broker) ClearRetained(topicName string) error {
+	if err := b.retained.clear(topicName); err != nil {
+		return err
+	}
+	if topic, err := b.GetTopic(topicName); err == nil {
+		topic.setRetained(nil)
+	}
+	return nil
+}
+
+// Schedule holds a message and publishes it to its topic once the given time is reached.
+// like Publish, it rejects IDs already seen within the topic's dedup window.
+func (b *Broker) Schedule(topicName string, msg *types.Message, at time.Time) error {
+	if IsWildcard(topicName) {
+		return errWildcardTopic
+	}
+	topic, err := b.topicFor(topicName)
+	if err != nil {
+		return err
+	}
+	if err := topic.checkSize(msg); err != nil {
+		return err
+	}
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+		msg.Topic = topicName
+		return b.scheduler.add(msg, at)
+	}
+	if !topic.dedup.record(msg.ID, time.Now()) {
+		return ErrDuplicate
+	}
+	msg.Topic = topicName
+	if err := b.scheduler.add(msg, at); err != nil {
+		topic.dedup.forget(msg.ID)
+		return err
+	}
 	return nil
 }
 
+// SubscribeOptions tunes a new subscription.
+type SubscribeOptions struct {
+	Group    string // subscribers sharing a group compete for messages, each going to one of them
+	Prefetch int    // max unacknowledged messages, 0 = unlimited
+	Filter   string // filter expression over headers, priority and key, see CompileFilter
+	Offset   string // where to start reading a log topic: earliest, latest (default), an offset or an RFC 3339 time
+	Durable  bool   // keep the subscription while its client is away, see Detach
+	Overflow string // OverflowDrop or OverflowSpill when the outbox is full, empty = topic default
+
+	// ConfirmWrites starts the ack deadline of a message once the caller reports it
+	// written to the client with Written, rather than when it enters MessageChannel.
+	ConfirmWrites bool
+}
+
 // Subscribe adds a subscriber to a topic.
-func (b *Broker) Subscribe(topicName, clientID string) (*Subscription, error) {
-	b.mu.Lock()
-	topic, exists := b.Topics[topicName]
-	if !exists {
-		topic = NewTopic(topicName, b.Config.MaxQueueSize)
-		b.Topics[topicName] = topic
+func (b *Broker) Subscribe(topicName, clientID string, opts SubscribeOptions) (*Subscription, error) {
+	if opts.Prefetch < 0 {
+		return nil, errors.New("prefetch must be >= 0")
+	}
+	if opts.Overflow != "" && opts.Overflow != OverflowDrop && opts.Overflow != OverflowSpill {
+		return nil, errors.New("overflow must be drop or spill")
+	}
+	filter, err := CompileFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if IsWildcard(topicName) {
+		return b.subscribeWildcard(topicName, clientID, opts, filter)
+	}
+	topic := b.getOrCreateTopic(topicName)
+	id := clientID + "-" + topicName
+	if opts.Durable {
+		if sub, ok := topic.resume(id, opts); ok {
+			log.Printf("topic %s: durable subscription %s resumed", topicName, id)
+			return sub, nil
+		}
 	}
-	b.mu.Unlock()
 
-	sub := NewSubscription(clientID+"-"+topicName, topicName, clientID, 100, nil)
-	topic.AddSubscription(sub)
+	sub := NewSubscription(id, topicName, clientID, 100, filter)
+	sub.FilterExpr = opts.Filter
+	sub.Group = opts.Group
+	sub.AckTimeout = b.Config.AckTimeout
+	sub.SetPrefetch(opts.Prefetch)
+	sub.StartOffset = opts.Offset
+	sub.Durable = opts.Durable
+	sub.ConfirmWrites = opts.ConfirmWrites
+	sub.Overflow = opts.Overflow
+	if sub.Overflow == "" {
+		sub.Overflow = topic.Config.Overflow
+	}
+	if err := topic.AddSubscription(sub); err != nil {
+		return nil, err
+	}
 
 	b.mu.Lock()
 	b.ActiveSubscriptions++
@@ -126,16 +546,201 @@ func (b *Broker) Subscribe(topicName, clientID string) (*Subscription, error) {
 	return sub, nil
 }
 
-// Unsubscribe removes a subscription by ID.
-func (b *Broker) Unsubscribe(subID string) {
+// subscribeWildcard subscribes to every existing and future topic matching pattern.
+// the returned subscription only carries the channel the matched topics deliver to.
+func (b *Broker) subscribeWildcard(pattern, clientID string, opts SubscribeOptions, filter func(*types.Message) bool) (*Subscription, error) {
+	if err := validatePattern(pattern); err != nil {
+		return nil, err
+	}
+	id := clientID + "-" + pattern
+	if opts.Durable {
+		if head, ok := b.resumeWildcard(id, opts); ok {
+			log.Printf("durable subscription %s resumed", id)
+			return head, nil
+		}
+	}
+	b.Unsubscribe(id)
+
+	w := &wildcardSubscription{
+		head:   NewSubscription(id, pattern, clientID, 100, filter),
+		opts:   opts,
+		topics: make(map[string]*Subscription),
+	}
+	w.head.FilterExpr = opts.Filter
+	w.head.Durable = opts.Durable
+	w.head.SetPrefetch(opts.Prefetch)
+	b.mu.Lock()
+	b.wildcards[id] = w
+	for name, topic := range b.Topics {
+		if !b.wildcardMatch(pattern, name) {
+			continue
+		}
+		if err := w.attach(topic, b.Config.AckTimeout); err != nil {
+			for attached := range w.topics {
+				b.Topics[attached].RemoveSubscription(id)
+			}
+			delete(b.wildcards, id)
+			b.mu.Unlock()
+			w.head.Close()
+			return nil, err
+		}
+	}
+	b.ActiveSubscriptions++
+	b.mu.Unlock()
+	return w.head, nil
+}
+
+// Detach pauses the durable subscription subID after its client disconnected. it keeps
+// collecting messages, up to the topic's MaxBacklog, and resumes when the client
+// subscribes again. subscriptions that are not durable are left alone.
+func (b *Broker) Detach(subID string) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
+	for _, topic := range b.Topics {
+		topic.Detach(subID)
+	}
+	if w, ok := b.wildcards[subID]; ok && w.head.Durable {
+		w.head.setActive(false)
+		// what is left in the channel was requeued by the matched topics
+		for len(w.head.MessageChannel) > 0 {
+			<-w.head.MessageChannel
+		}
+	}
+}
+
+// resumeWildcard restarts a detached durable wildcard subscription on every matched topic.
+func (b *Broker) resumeWildcard(id string, opts SubscribeOptions) (*Subscription, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w, ok := b.wildcards[id]
+	if !ok || !w.head.Detached() || w.opts.Group != opts.Group || w.opts.Filter != opts.Filter {
+		return nil, false
+	}
+	w.opts.Prefetch = opts.Prefetch
+	w.head.SetPrefetch(opts.Prefetch)
+	w.head.setActive(true)
+	for name := range w.topics {
+		b.Topics[name].resume(id, opts)
+	}
+	return w.head, true
+}
+
+// Unsubscribe removes a subscription by ID.
+func (b *Broker) Unsubscribe(subID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	for _, topic := range b.Topics {
 		topic.RemoveSubscription(subID)
 	}
+	if w, ok := b.wildcards[subID]; ok {
+		delete(b.wildcards, subID)
+		w.head.Close()
+	}
+}
+
+// Ack acknowledges a message delivered to the given subscription.
+func (b *Broker) Ack(topicName, subID, msgID string) error {
+	topic, err := b.GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	sub, ok := topic.GetSubscription(subID)
+	if !ok {
+		return errors.New("subscription not found")
+	}
+	if !sub.Ack(msgID) {
+		return errors.New("message not awaiting acknowledgement")
+	}
+	return nil
+}
+
+// Written starts the ack deadline of a message delivered to a subscription made
+// with ConfirmWrites, once it reached the client.
+func (b *Broker) Written(topicName, subID, msgID string) error {
+	topic, err := b.GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	sub, ok := topic.GetSubscription(subID)
+	if !ok {
+		return errors.New("subscription not found")
+	}
+	if !sub.Written(msgID) {
+		return errors.New("message not awaiting a write")
+	}
+	return nil
+}
+
+// Nack rejects a message delivered to the given subscription, redelivering or
+// dead-lettering it according to opts.
+func (b *Broker) Nack(topicName, subID, msgID string, opts NackOptions) error {
+	topic, err := b.GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	bm, err := topic.Nack(subID, msgID, opts)
+	if err != nil {
+		return err
+	}
+	if bm != nil {
+		return b.deadLetter(topic, bm)
+	}
+	return nil
+}
+
+// Credit tops up the prefetch window of a subscription by n messages.
+// a wildcard subscription gets the credit once, for all its matched topics.
+func (b *Broker) Credit(topicName, subID string, n int) error {
+	b.mu.RLock()
+	w, ok := b.wildcards[subID]
+	if ok && w.head.Topic == topicName {
+		w.head.AddCredit(n)
+		b.mu.RUnlock()
+		return nil
+	}
+	b.mu.RUnlock()
+
+	topic, err := b.GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	return topic.Credit(subID, n)
+}
+
+// redeliveryLoop periodically re-sends messages whose ack deadline passed.
+func (b *Broker) redeliveryLoop() {
+	interval := b.Config.RedeliveryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			exhausted := make(map[*Topic][]*BrokerMessage)
+			b.mu.RLock()
+			for _, topic := range b.Topics {
+				if dead := topic.Redeliver(); len(dead) > 0 {
+					exhausted[topic] = dead
+				}
+			}
+			b.mu.RUnlock()
+
+			for topic, dead := range exhausted {
+				for _, bm := range dead {
+					_ = b.deadLetter(topic, bm) // kept and retried on the next pass
+				}
+			}
+		case <-b.stopCleanup:
+			return
+		}
+	}
 }
 
-// cleanupLoop periodically removes expired messages.
+// cleanupLoop periodically removes expired messages, dead-lettering them
+// on topics configured to do so.
 func (b *Broker) cleanupLoop() {
 	ticker := time.NewTicker(b.Config.CleanupInterval)
 	defer ticker.Stop()
@@ -143,11 +748,29 @@ func (b *Broker) cleanupLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			expired := make(map[*Topic][]*BrokerMessage)
 			b.mu.RLock()
 			for _, topic := range b.Topics {
-				topic.Queue.RemoveExpired(b.Config.MessageTTL)
+				topic.dedup.expire(time.Now())
+				if topic.log != nil {
+					topic.log.trim(time.Now())
+					topic.log.compact()
+				}
+				if gone := topic.RemoveExpired(); len(gone) > 0 {
+					expired[topic] = gone
+				}
 			}
 			b.mu.RUnlock()
+
+			for topic, gone := range expired {
+				if dl := topic.Config.DeadLetterExpired; dl == nil || !*dl {
+					log.Printf("topic %s: dropped %d expired messages", topic.Name, len(gone))
+					continue
+				}
+				for _, bm := range gone {
+					_ = b.deadLetter(topic, bm) // kept and retried on the next pass
+				}
+			}
 		case <-b.stopCleanup:
 			return
 		}
@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func TestScheduleToMissingInbox(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	err := b.Schedule(inboxPrefix+"gone", &types.Message{Payload: []byte("x")}, time.Now().Add(time.Minute))
+	if !errors.Is(err, errNoInbox) {
+		t.Fatalf("Schedule returned %v, want %v", err, errNoInbox)
+	}
+	if _, err := b.GetTopic(inboxPrefix + "gone"); err == nil {
+		t.Fatal("Schedule created the inbox")
+	}
+}
+
+func TestScheduledReplyToDeletedInbox(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	inbox := b.CreateInbox("requester")
+	if err := b.Schedule(inbox, &types.Message{Payload: []byte("x")}, time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteTopic(inbox); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for b.scheduler.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduled message for a deleted inbox is still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := b.GetTopic(inbox); err == nil {
+		t.Fatal("releasing the scheduled message recreated the inbox")
+	}
+}
+
+func TestTopicOverridesDeadLetterExpired(t *testing.T) {
+	off, on := false, true
+	b := newTestBroker(t, BrokerConfig{
+		DeadLetterExpired: true,
+		Topics: map[string]TopicConfig{
+			"quiet": {DeadLetterExpired: &off},
+			"loud":  {DeadLetterExpired: &on},
+		},
+	})
+	for name, want := range map[string]bool{"quiet": false, "loud": true, "other": true} {
+		if got := *b.topicConfig(name).DeadLetterExpired; got != want {
+			t.Errorf("topic %s: DeadLetterExpired = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"queuego/pkg/types"
+	"strconv"
+	"time"
+)
+
+// deadLetter moves a message that could not be delivered to the topic's dead-letter topic,
+// stamping headers with the original topic, delivery count and last error.
+// when the dead-letter topic refuses it, the message goes back to the subscription
+// or queue it came from and the next redelivery or cleanup pass tries again.
+func (b *Broker) deadLetter(topic *Topic, bm *BrokerMessage) error {
+	bm.mu.Lock()
+	count, reason := bm.DeliveryCount, bm.LastError
+	bm.mu.Unlock()
+
+	// copy the message, the original is shared with other subscriptions
+	headers := make(map[string]string, len(bm.Msg.Headers)+3)
+	for k, v := range bm.Msg.Headers {
+		headers[k] = v
+	}
+	headers[types.HeaderOriginalTopic] = topic.Name
+	headers[types.HeaderDeliveryCount] = strconv.Itoa(count)
+	headers[types.HeaderLastError] = reason
+
+	dlq := topic.Config.DeadLetterTopic
+	msg := *bm.Msg
+	msg.Topic = dlq
+	msg.Headers = headers
+	msg.ExpiresAt = time.Time{} // the dead-letter topic applies its own TTL
+	msg.Retain = false
+
+	if err := b.publish(dlq, &msg); err != nil {
+		log.Printf("dead-letter of message %s from %s to %s failed, kept for another try: %v", msg.ID, topic.Name, dlq, err)
+		topic.keep(bm)
+		return err
+	}
+	log.Printf("message %s dead-lettered from %s to %s after %d attempts: %s", msg.ID, topic.Name, dlq, count, reason)
+	return nil
+}
+
+// Redrive moves up to max messages (0 = all) from a dead-letter topic back to
+// the topics they originally came from, and returns how many were moved.
+func (b *Broker) Redrive(dlqName string, max int) (int, error) {
+	dlq, err := b.GetTopic(dlqName)
+	if err != nil {
+		return 0, err
+	}
+	if dlq.log != nil {
+		return 0, errors.New("topic " + dlqName + " is a log topic, its messages are replayed by offset instead")
+	}
+
+	moved := 0
+	for _, q := range dlq.Partitions {
+		for max <= 0 || moved < max {
+			msg, err := q.TryPop()
+			if err != nil {
+				break
+			}
+
+			source := msg.Headers[types.HeaderOriginalTopic]
+			if source == "" {
+				q.PushFront(msg)
+				return moved, errors.New("message " + msg.ID + " has no original topic")
+			}
+
+			headers := make(map[string]string, len(msg.Headers))
+			for k, v := range msg.Headers {
+				headers[k] = v
+			}
+			delete(headers, types.HeaderOriginalTopic)
+			delete(headers, types.HeaderDeliveryCount)
+			delete(headers, types.HeaderLastError)
+			redriven := *msg
+			redriven.Topic = source
+			redriven.Headers = headers
+			redriven.ExpiresAt = time.Time{}
+
+			if err := b.publish(source, &redriven); err != nil {
+				q.PushFront(msg)
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
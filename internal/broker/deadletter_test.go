@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func TestDeadLetterAfterMaxDeliveries(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		AckTimeout:         20 * time.Millisecond,
+		RedeliveryInterval: 5 * time.Millisecond,
+		MaxDeliveries:      2,
+	})
+	sub, err := b.Subscribe("orders", "worker", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "orders", 1)
+
+	first := next(t, sub)
+	if again := next(t, sub); again.ID != first.ID {
+		t.Fatalf("redelivered %s, want %s", again.ID, first.ID)
+	}
+	expectNone(t, sub, 100*time.Millisecond)
+
+	dlq, err := b.Subscribe("orders.dlq", "ops", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := next(t, dlq)
+	if dead.ID != first.ID {
+		t.Fatalf("dead-lettered %s, want %s", dead.ID, first.ID)
+	}
+	if got := dead.Headers[types.HeaderOriginalTopic]; got != "orders" {
+		t.Errorf("original topic header = %q, want orders", got)
+	}
+	if got := dead.Headers[types.HeaderDeliveryCount]; got != "2" {
+		t.Errorf("delivery count header = %q, want 2", got)
+	}
+	if _, ok := first.Headers[types.HeaderOriginalTopic]; ok {
+		t.Error("dead-lettering modified the original message headers")
+	}
+}
+
+func TestRedriveReturnsMessagesToSource(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		AckTimeout:         100 * time.Millisecond,
+		RedeliveryInterval: 5 * time.Millisecond,
+		MaxDeliveries:      1,
+		Topics:             map[string]TopicConfig{"orders": {DeadLetterTopic: "orders.failed"}},
+	})
+	sub, err := b.Subscribe("orders", "worker", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "orders", 3)
+	for i := 0; i < 3; i++ {
+		next(t, sub)
+	}
+	eventually(t, "messages to be dead-lettered", func() bool {
+		dlq, err := b.GetTopic("orders.failed")
+		return err == nil && dlq.Len() == 3
+	})
+
+	moved, err := b.Redrive("orders.failed", 2)
+	if err != nil || moved != 2 {
+		t.Fatalf("Redrive = %d, %v, want 2, nil", moved, err)
+	}
+	for i := 0; i < 2; i++ {
+		msg := next(t, sub)
+		for _, h := range []string{types.HeaderOriginalTopic, types.HeaderDeliveryCount, types.HeaderLastError} {
+			if _, ok := msg.Headers[h]; ok {
+				t.Errorf("redriven message kept header %s", h)
+			}
+		}
+		if err := b.Ack("orders", sub.ID, msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dlq, _ := b.GetTopic("orders.failed"); dlq.Len() != 1 {
+		t.Fatalf("%d messages left in the dead-letter topic, want 1", dlq.Len())
+	}
+	if _, err := b.Redrive("missing", 0); err == nil {
+		t.Fatal("redrive of a missing topic succeeded")
+	}
+}
+
+func TestDeadLetterRetriedWhileDLQFull(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		AckTimeout:         20 * time.Millisecond,
+		RedeliveryInterval: 5 * time.Millisecond,
+		MaxDeliveries:      1,
+		Topics:             map[string]TopicConfig{"orders.dlq": {MaxQueueSize: 1}},
+	})
+	sub, err := b.Subscribe("orders", "worker", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "orders", 2)
+	next(t, sub)
+	next(t, sub)
+
+	// the dead-letter topic holds one message, the other stays in flight
+	eventually(t, "the dead-letter topic to fill up", func() bool {
+		dlq, err := b.GetTopic("orders.dlq")
+		return err == nil && dlq.Len() == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := len(sub.Unacked()); n != 1 {
+		t.Fatalf("%d messages kept after the dead-letter topic refused one, want 1", n)
+	}
+	kept := sub.Unacked()[0]
+	if err := b.Nack("orders", sub.ID, kept.ID, NackOptions{DeadLetter: true}); err == nil {
+		t.Fatal("Nack into a full dead-letter topic succeeded")
+	}
+
+	ops, err := b.Subscribe("orders.dlq", "ops", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(t, ops)
+	if dead := next(t, ops); dead.ID != kept.ID {
+		t.Fatalf("dead-lettered %s, want the kept %s", dead.ID, kept.ID)
+	}
+	eventually(t, "the kept message to leave the subscription", func() bool {
+		return len(sub.Unacked()) == 0
+	})
+}
+
+func TestExpiredMessagesKeptWhileDLQFull(t *testing.T) {
+	on := true
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		CleanupInterval:    10 * time.Millisecond,
+		RedeliveryInterval: 10 * time.Millisecond,
+		Topics: map[string]TopicConfig{
+			"orders":  {DeadLetterTopic: "expired", DeadLetterExpired: &on},
+			"jobs":    {DeadLetterTopic: "expired", DeadLetterExpired: &on},
+			"expired": {MaxQueueSize: 1},
+		},
+	})
+	publishAll(t, b, "expired", 1)
+
+	// one message expires queued, the other in flight
+	expiring := func(id, topic string) *types.Message {
+		return &types.Message{ID: id, Topic: topic, Payload: []byte(id), ExpiresAt: time.Now().Add(50 * time.Millisecond)}
+	}
+	if err := b.Publish("orders", expiring("queued", "orders")); err != nil {
+		t.Fatal(err)
+	}
+	worker, err := b.Subscribe("jobs", "worker", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("jobs", expiring("inflight", "jobs")); err != nil {
+		t.Fatal(err)
+	}
+	next(t, worker)
+
+	time.Sleep(150 * time.Millisecond)
+	orders, err := b.GetTopic("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := orders.Len(); n != 1 {
+		t.Fatalf("%d messages left queued after the dead-letter topic refused them, want 1", n)
+	}
+	if n := len(worker.Unacked()); n != 1 {
+		t.Fatalf("%d messages left in flight after the dead-letter topic refused them, want 1", n)
+	}
+
+	ops, err := b.Subscribe("expired", "ops", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(t, ops)
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := next(t, ops)
+		got[msg.ID] = true
+		if err := b.Ack("expired", ops.ID, msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !got["queued"] || !got["inflight"] {
+		t.Fatalf("dead-lettered %v, want queued and inflight", got)
+	}
+}
@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDuplicate is returned when a message ID was already published to the topic
+// within its deduplication window.
+var ErrDuplicate = errors.New("duplicate message")
+
+// dedupWindow remembers the message IDs published to a topic for a while,
+// so retried publishes are acknowledged without being enqueued twice.
+type dedupWindow struct {
+	window time.Duration
+	seen   map[string]time.Time // messageID -> time it was published
+	mu     sync.Mutex
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// record remembers id and reports whether it was new. a zero window disables deduplication.
+func (d *dedupWindow) record(id string, now time.Time) bool {
+	if d.window <= 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if at, ok := d.seen[id]; ok && now.Sub(at) < d.window {
+		return false
+	}
+	d.seen[id] = now
+	return true
+}
+
+// forget drops id, e.g. when the publish it was recorded for failed.
+func (d *dedupWindow) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, id)
+}
+
+// expire drops the IDs that fell out of the window.
+func (d *dedupWindow) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, at := range d.seen {
+		if now.Sub(at) >= d.window {
+			delete(d.seen, id)
+		}
+	}
+}
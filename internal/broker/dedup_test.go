@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func TestDedupWindow(t *testing.T) {
+	now := time.Now()
+	d := newDedupWindow(time.Minute)
+	if !d.record("a", now) {
+		t.Fatal("first record of a reported a duplicate")
+	}
+	if d.record("a", now.Add(30*time.Second)) {
+		t.Fatal("a was not a duplicate within the window")
+	}
+	if !d.record("a", now.Add(time.Minute)) {
+		t.Fatal("a was still a duplicate after the window")
+	}
+
+	d.record("b", now)
+	d.forget("b")
+	if !d.record("b", now) {
+		t.Fatal("forgotten ID reported as a duplicate")
+	}
+
+	d.expire(now.Add(2 * time.Minute))
+	if len(d.seen) != 0 {
+		t.Fatalf("%d IDs left after expiry", len(d.seen))
+	}
+
+	off := newDedupWindow(0)
+	if !off.record("a", now) || !off.record("a", now) {
+		t.Fatal("a zero window reported a duplicate")
+	}
+}
+
+func TestPublishDuplicateID(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 1, DedupWindow: time.Minute})
+	if err := b.Publish("orders", &types.Message{ID: "p-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("orders", &types.Message{ID: "p-1"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("republish returned %v, want ErrDuplicate", err)
+	}
+	if err := b.Schedule("orders", &types.Message{ID: "p-1"}, time.Now()); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("schedule of a published ID returned %v, want ErrDuplicate", err)
+	}
+
+	// a publish that failed is not remembered, so the producer can retry it
+	if err := b.Publish("orders", &types.Message{ID: "p-2"}); err == nil {
+		t.Fatal("publish to a full topic succeeded")
+	}
+	sub, err := b.Subscribe("orders", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := next(t, sub); msg.ID != "p-1" {
+		t.Fatalf("delivered %s, want p-1", msg.ID)
+	}
+	expectNone(t, sub, 50*time.Millisecond)
+	publish := func() error { return b.Publish("orders", &types.Message{ID: "p-2"}) }
+	eventually(t, "retry of p-2 to succeed", func() bool { return publish() == nil })
+	if msg := next(t, sub); msg.ID != "p-2" {
+		t.Fatalf("delivered %s, want p-2", msg.ID)
+	}
+}
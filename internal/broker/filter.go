@@ -0,0 +1,292 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"queuego/pkg/types"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filter expressions select messages by header, priority and key, e.g.
+//
+//	region = 'eu' AND priority > 5
+//	NOT (status = 'test' OR x-retry >= 3)
+//
+// identifiers name a header, except priority and key which refer to the message fields.
+// any comparison on a missing header is false. comparisons against a number are numeric
+// and also false when the value is not a number.
+
+// filterFunc reports whether a message matches a compiled filter.
+type filterFunc func(*types.Message) bool
+
+// CompileFilter parses a filter expression. an empty expression matches every message.
+func CompileFilter(expr string) (func(*types.Message) bool, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("filter: unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return f, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokEOF filterTokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+// tokenizeFilter splits a filter expression into tokens.
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokRParen, ")", i})
+			i++
+		case c == '\'':
+			end := strings.IndexByte(expr[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("filter: unterminated string at position %d", i)
+			}
+			tokens = append(tokens, filterToken{tokString, expr[i+1 : i+1+end], i})
+			i += end + 2
+		case strings.ContainsRune("=!<>", c):
+			op := string(c)
+			if i+1 < len(expr) && expr[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("filter: expected != at position %d", i)
+			}
+			tokens = append(tokens, filterToken{tokOp, op, i})
+			i += len(op)
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			start := i
+			for i < len(expr) && (expr[i] == '-' || expr[i] == '.' || unicode.IsDigit(rune(expr[i]))) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokNumber, expr[start:i], start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(expr) && isFilterIdentChar(rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokIdent, expr[start:i], start})
+		default:
+			return nil, fmt.Errorf("filter: unexpected %q at position %d", c, i)
+		}
+	}
+	return append(tokens, filterToken{tokEOF, "end of expression", len(expr)}), nil
+}
+
+func isFilterIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '-' || c == '.'
+}
+
+// filterParser is a recursive descent parser over:
+//
+//	or         = and { OR and }
+//	and        = not { AND not }
+//	not        = NOT not | primary
+//	primary    = "(" or ")" | identifier op value
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the next token if it is the given keyword, case-insensitively.
+func (p *filterParser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokIdent && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *types.Message) bool { return l(m) || right(m) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterFunc, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *types.Message) bool { return l(m) && right(m) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterFunc, error) {
+	if p.keyword("NOT") {
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *types.Message) bool { return !f(m) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterFunc, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokLParen:
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("filter: expected ) at position %d", closing.pos)
+		}
+		return f, nil
+	case tokIdent:
+		return p.parseComparison(tok.text)
+	default:
+		return nil, fmt.Errorf("filter: expected a header name at position %d, got %q", tok.pos, tok.text)
+	}
+}
+
+// parseComparison parses the operator and value following field.
+func (p *filterParser) parseComparison(field string) (filterFunc, error) {
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("filter: expected a comparison after %s at position %d", field, op.pos)
+	}
+	value := p.next()
+	get := filterField(field)
+
+	switch value.kind {
+	case tokString:
+		cmp, err := compareOp(op.text)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *types.Message) bool {
+			v, ok := get(m)
+			return ok && cmp(strings.Compare(v, value.text))
+		}, nil
+	case tokNumber:
+		want, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid number %q at position %d", value.text, value.pos)
+		}
+		cmp, err := compareOp(op.text)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *types.Message) bool {
+			v, ok := get(m)
+			if !ok {
+				return false
+			}
+			got, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return false
+			}
+			switch {
+			case got < want:
+				return cmp(-1)
+			case got > want:
+				return cmp(1)
+			}
+			return cmp(0)
+		}, nil
+	default:
+		return nil, fmt.Errorf("filter: expected a quoted string or number at position %d, got %q", value.pos, value.text)
+	}
+}
+
+// filterField returns the accessor for a field name used in a filter.
+func filterField(name string) func(*types.Message) (string, bool) {
+	switch name {
+	case "priority":
+		return func(m *types.Message) (string, bool) { return strconv.Itoa(m.Priority), true }
+	case "key":
+		return func(m *types.Message) (string, bool) { return m.Key, m.Key != "" }
+	}
+	return func(m *types.Message) (string, bool) {
+		v, ok := m.Headers[name]
+		return v, ok
+	}
+}
+
+// compareOp turns an operator into a test over the result of a three-way comparison.
+func compareOp(op string) (func(int) bool, error) {
+	switch op {
+	case "=":
+		return func(c int) bool { return c == 0 }, nil
+	case "!=":
+		return func(c int) bool { return c != 0 }, nil
+	case "<":
+		return func(c int) bool { return c < 0 }, nil
+	case "<=":
+		return func(c int) bool { return c <= 0 }, nil
+	case ">":
+		return func(c int) bool { return c > 0 }, nil
+	case ">=":
+		return func(c int) bool { return c >= 0 }, nil
+	}
+	return nil, errors.New("filter: unknown operator " + op)
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func TestCompileFilter(t *testing.T) {
+	msg := &types.Message{
+		Priority: 7,
+		Key:      "order-1",
+		Headers: map[string]string{
+			"region":  "eu",
+			"status":  "live",
+			"count":   "10",
+			"version": "9",
+			"x-retry": "2",
+		},
+	}
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"", true},
+		{"region = 'eu'", true},
+		{"region != 'eu'", false},
+		{"region = 'us'", false},
+
+		// comparisons on a missing header are false, whatever the operator
+		{"missing = 'x'", false},
+		{"missing != 'x'", false},
+		{"NOT missing = 'x'", true},
+
+		// priority and key refer to the message fields
+		{"priority > 5", true},
+		{"priority >= 7", true},
+		{"priority < 7", false},
+		{"priority = 7.0", true},
+		{"key = 'order-1'", true},
+		{"key <= 'order-0'", false},
+
+		// numbers compare numerically, quoted values as strings
+		{"count > 9", true},
+		{"count > '9'", false},
+		{"version < 10", true},
+		{"version < '10'", false},
+		{"region > 1", false},
+		{"x-retry >= -1", true},
+
+		// NOT binds tighter than AND, which binds tighter than OR
+		{"region = 'eu' OR status = 'x' AND priority > 100", true},
+		{"(region = 'eu' OR status = 'x') AND priority > 100", false},
+		{"region = 'us' AND priority > 5 OR status = 'live'", true},
+		{"NOT region = 'us' AND priority > 5", true},
+		{"NOT (region = 'eu' AND priority > 5)", false},
+		{"NOT NOT region = 'eu'", true},
+		{"region = 'eu' and not status = 'test'", true},
+		{"((region = 'eu'))", true},
+	}
+	for _, tt := range tests {
+		f, err := CompileFilter(tt.expr)
+		if err != nil {
+			t.Errorf("CompileFilter(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := f == nil || f(msg); got != tt.match {
+			t.Errorf("%q matched %v, want %v", tt.expr, got, tt.match)
+		}
+	}
+}
+
+func TestCompileFilterRejects(t *testing.T) {
+	for _, expr := range []string{
+		"region = 'eu",
+		"region ! 'eu'",
+		"region 'eu'",
+		"= 'eu'",
+		"region = eu",
+		"region =< 'eu'",
+		"(region = 'eu'",
+		"region = 'eu')",
+		"region = 'eu' status = 'live'",
+		"region = 'eu' AND",
+		"NOT",
+		"count = 1.2.3",
+		"region @ 'eu'",
+	} {
+		if _, err := CompileFilter(expr); err == nil {
+			t.Errorf("CompileFilter(%q) accepted an invalid expression", expr)
+		}
+	}
+}
+
+func TestFilteredSubscription(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	eu, err := b.Subscribe("orders", "eu", SubscribeOptions{Filter: "region = 'eu' AND priority >= 5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("orders", "bad", SubscribeOptions{Filter: "region ="}); err == nil {
+		t.Fatal("subscribe with an invalid filter succeeded")
+	}
+
+	for _, m := range []*types.Message{
+		{ID: "us", Headers: map[string]string{"region": "us"}, Priority: 9},
+		{ID: "eu-low", Headers: map[string]string{"region": "eu"}, Priority: 1},
+		{ID: "eu-high", Headers: map[string]string{"region": "eu"}, Priority: 7},
+	} {
+		if err := b.Publish("orders", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg := next(t, eu); msg.ID != "eu-high" {
+		t.Fatalf("filtered subscription got %s, want eu-high", msg.ID)
+	}
+	expectNone(t, eu, 50*time.Millisecond)
+}
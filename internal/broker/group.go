@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"queuego/internal/queue"
+	"queuego/pkg/types"
+)
+
+// consumerGroup load-balances a topic's messages across competing subscriptions:
+// each message goes to exactly one member. on unpartitioned topics members pull from
+// a shared outbox whenever their prefetch window has room, so the least loaded member
+// takes the next one. on partitioned topics each partition is owned by one member,
+// which keeps the messages of a key in order.
+type consumerGroup struct {
+	name     string
+	members  []*Subscription
+	outbox   queue.MessageQueue // shared by all members, nil on partitioned topics
+	cursor   *logCursor         // fills the shared outbox on log topics
+	overflow string             // policy of the member that formed the group
+}
+
+func newConsumerGroup(name string, outbox queue.MessageQueue) *consumerGroup {
+	return &consumerGroup{name: name, outbox: outbox}
+}
+
+// add registers a member, replacing a previous one with the same ID.
+func (g *consumerGroup) add(sub *Subscription) {
+	for i, m := range g.members {
+		if m.ID == sub.ID {
+			g.members[i] = sub
+			return
+		}
+	}
+	g.members = append(g.members, sub)
+}
+
+// remove drops a member from the group.
+func (g *consumerGroup) remove(subID string) {
+	for i, m := range g.members {
+		if m.ID == subID {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// compatible reports whether sub uses the same filter as the other members.
+func (g *consumerGroup) compatible(sub *Subscription) bool {
+	for _, m := range g.members {
+		if m.ID != sub.ID && m.FilterExpr != sub.FilterExpr {
+			return false
+		}
+	}
+	return true
+}
+
+// accepts reports whether msg passes the filter shared by the members.
+func (g *consumerGroup) accepts(msg *types.Message) bool {
+	return len(g.members) == 0 || g.members[0].Accepts(msg)
+}
+
+// owner returns the member consuming partition p of a partitioned topic.
+func (g *consumerGroup) owner(p int) *Subscription {
+	return g.members[p%len(g.members)]
+}
+
+// outboxFor returns the outbox that receives the group's messages from partition p.
+func (g *consumerGroup) outboxFor(p int) queue.MessageQueue {
+	if g.outbox != nil {
+		return g.outbox
+	}
+	return g.owner(p).outbox
+}
+
+// detached reports whether the members that would receive a message from partition p
+// all wait for their clients to come back.
+func (g *consumerGroup) detached(p int) bool {
+	if g.outbox == nil {
+		return g.owner(p).Detached()
+	}
+	for _, m := range g.members {
+		if !m.Detached() {
+			return false
+		}
+	}
+	return len(g.members) > 0
+}
+
+// rebalance moves the messages waiting in member outboxes to the members that now
+// own their partitions, after the membership changed. messages already delivered
+// stay with their member until acknowledged.
+func (g *consumerGroup) rebalance() {
+	if g.outbox != nil || len(g.members) == 0 {
+		return
+	}
+	var pending []*types.Message
+	for _, m := range g.members {
+		pending = append(pending, drain(m.outbox)...)
+	}
+	g.requeue(pending)
+}
+
+// requeue puts messages at the front of their owners' outboxes, keeping their order.
+func (g *consumerGroup) requeue(msgs []*types.Message) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		g.owner(msgs[i].Partition).outbox.PushFront(msgs[i])
+	}
+}
@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func TestGroupDeliversEachMessageOnce(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 100})
+	a, err := b.Subscribe("jobs", "a", SubscribeOptions{Group: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Subscribe("jobs", "c", SubscribeOptions{Group: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := b.Subscribe("jobs", "audit", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "jobs", 10)
+
+	seen := make(map[string]bool)
+	for len(seen) < 10 {
+		var msg *types.Message
+		var sub *Subscription
+		select {
+		case msg = <-a.MessageChannel:
+			sub = a
+		case msg = <-c.MessageChannel:
+			sub = c
+		case <-time.After(time.Second):
+			t.Fatalf("group received %d of 10 messages", len(seen))
+		}
+		if seen[msg.ID] {
+			t.Fatalf("message %s delivered twice", msg.ID)
+		}
+		seen[msg.ID] = true
+		if err := b.Ack("jobs", sub.ID, msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectNone(t, a, 50*time.Millisecond)
+	expectNone(t, c, 0)
+	if got := receive(t, b, audit, 10); got != 10 {
+		t.Fatalf("subscriber outside the group received %d of 10 messages", got)
+	}
+}
+
+func TestGroupHandsUnackedToRemainingMember(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 100})
+	a, err := b.Subscribe("jobs", "a", SubscribeOptions{Group: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Subscribe("jobs", "c", SubscribeOptions{Group: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "jobs", 1)
+
+	var leaving, staying *Subscription
+	var id string
+	select {
+	case msg := <-a.MessageChannel:
+		leaving, staying, id = a, c, msg.ID
+	case msg := <-c.MessageChannel:
+		leaving, staying, id = c, a, msg.ID
+	case <-time.After(time.Second):
+		t.Fatal("no message delivered")
+	}
+
+	b.Unsubscribe(leaving.ID)
+	if msg := next(t, staying); msg.ID != id {
+		t.Fatalf("remaining member got %s, want %s", msg.ID, id)
+	}
+}
+
+func TestGroupSkipsMembersWithoutCredit(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 100})
+	busy, err := b.Subscribe("jobs", "busy", SubscribeOptions{Group: "workers", Prefetch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "jobs", 1)
+	next(t, busy)
+
+	// busy never acks, so everything else goes to idle
+	idle, err := b.Subscribe("jobs", "idle", SubscribeOptions{Group: "workers", Prefetch: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "jobs", 5)
+	for i := 0; i < 5; i++ {
+		next(t, idle)
+	}
+	expectNone(t, busy, 50*time.Millisecond)
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"queuego/internal/testutil"
+)
+
+// BenchmarkIdleTopics measures the CPU used by 1000 subscribed topics without
+// traffic per millisecond. distributors that polled every 10ms woke 100,000 times a second.
+func BenchmarkIdleTopics(b *testing.B) {
+	br := NewBroker(BrokerConfig{CleanupInterval: time.Minute, AckTimeout: time.Minute, RedeliveryInterval: time.Minute})
+	br.Start()
+	defer br.Stop()
+	for i := 0; i < 1000; i++ {
+		if _, err := br.Subscribe(fmt.Sprintf("idle.%d", i), "bench", SubscribeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	start := testutil.CPUTime(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(testutil.CPUTime(b)-start)/float64(b.N), "cpu-ns/op")
+}
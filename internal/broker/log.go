@@ -0,0 +1,253 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"queuego/internal/queue"
+	"queuego/internal/storage"
+	"queuego/pkg/types"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// topic modes
+const (
+	ModeQueue = "queue" // messages are removed once delivered
+	ModeLog   = "log"   // messages are retained with offsets and can be replayed
+)
+
+// start positions accepted by log subscriptions, besides an offset or an RFC 3339 time
+const (
+	OffsetEarliest = "earliest"
+	OffsetLatest   = "latest"
+)
+
+// logBatch is how many entries a cursor copies per read.
+const logBatch = 100
+
+// messageLog retains a topic's messages in offset order until retention drops them.
+type messageLog struct {
+	entries     []*types.Message // ascending offsets
+	next        int64            // offset of the next appended message
+	retention   time.Duration    // 0 = keep regardless of age
+	maxMessages int              // 0 = no limit
+	compacted   bool             // older messages are dropped once a newer one has the same key
+	store       *storage.FileStorage
+	appended    chan struct{} // closed and replaced on every append
+	mu          sync.Mutex
+}
+
+func newMessageLog(retention time.Duration, maxMessages int, compacted bool) *messageLog {
+	return &messageLog{
+		retention:   retention,
+		maxMessages: maxMessages,
+		compacted:   compacted,
+		appended:    make(chan struct{}),
+	}
+}
+
+// restore loads the entries persisted in store and keeps appending to it.
+func (l *messageLog) restore(store *storage.FileStorage) error {
+	msgs, err := store.All()
+	if err != nil {
+		return err
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Offset < msgs[j].Offset })
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+	l.entries = msgs
+	if len(msgs) > 0 {
+		l.next = msgs[len(msgs)-1].Offset + 1
+	}
+	return nil
+}
+
+// append assigns the next offset to msg and adds it to the log.
+func (l *messageLog) append(msg *types.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	msg.Offset = l.next
+	if l.store != nil {
+		if err := l.store.Append(msg); err != nil {
+			return err
+		}
+	}
+	l.next++
+	l.entries = append(l.entries, msg)
+	if l.maxMessages > 0 && len(l.entries) > l.maxMessages {
+		l.drop(len(l.entries) - l.maxMessages)
+	}
+
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return nil
+}
+
+// read returns up to logBatch entries from offset on, skipping entries that were
+// already trimmed. when there are none it returns a channel closed by the next append.
+func (l *messageLog) read(from int64) ([]*types.Message, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Offset >= from })
+	if i == len(l.entries) {
+		return nil, l.appended
+	}
+	end := i + logBatch
+	if end > len(l.entries) {
+		end = len(l.entries)
+	}
+	return append([]*types.Message(nil), l.entries[i:end]...), nil
+}
+
+// resolve turns a start position into an offset: earliest, latest (the default),
+// an explicit offset, or the first message published at or after an RFC 3339 time.
+func (l *messageLog) resolve(position string) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch position {
+	case "", OffsetLatest:
+		return l.next, nil
+	case OffsetEarliest:
+		if len(l.entries) > 0 {
+			return l.entries[0].Offset, nil
+		}
+		return l.next, nil
+	}
+	if offset, err := strconv.ParseInt(position, 10, 64); err == nil {
+		if offset < 0 {
+			return 0, errors.New("offset must be >= 0")
+		}
+		return offset, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, position)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %q: want earliest, latest, a number or an RFC 3339 time", position)
+	}
+	i := sort.Search(len(l.entries), func(i int) bool { return !l.entries[i].Timestamp.Before(at) })
+	if i == len(l.entries) {
+		return l.next, nil
+	}
+	return l.entries[i].Offset, nil
+}
+
+// trim drops the entries older than the retention period.
+func (l *messageLog) trim(now time.Time) {
+	if l.retention <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := sort.Search(len(l.entries), func(i int) bool { return now.Sub(l.entries[i].Timestamp) <= l.retention })
+	l.drop(n)
+}
+
+// compact drops the entries of a compacted log that a later entry with the same key
+// replaced. messages without a key are kept. the store compacts its own segments.
+func (l *messageLog) compact() {
+	if !l.compacted {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	latest := make(map[string]int64, len(l.entries))
+	for _, msg := range l.entries {
+		if msg.Key != "" {
+			latest[msg.Key] = msg.Offset
+		}
+	}
+	kept := make([]*types.Message, 0, len(latest))
+	for _, msg := range l.entries {
+		if msg.Key == "" || latest[msg.Key] == msg.Offset {
+			kept = append(kept, msg)
+		}
+	}
+	l.entries = kept
+}
+
+// drop removes the n oldest entries. callers hold l.mu.
+func (l *messageLog) drop(n int) {
+	if n <= 0 {
+		return
+	}
+	if l.store != nil {
+		for _, msg := range l.entries[:n] {
+			if err := l.store.Delete(msg.ID); err != nil {
+				log.Printf("log: deleting message %s at offset %d failed: %v", msg.ID, msg.Offset, err)
+			}
+		}
+	}
+	l.entries = append([]*types.Message(nil), l.entries[n:]...)
+}
+
+// len returns the number of retained entries.
+func (l *messageLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// logCursor feeds one subscription, or one consumer group, from a log topic.
+type logCursor struct {
+	wake   chan struct{} // signalled when a message leaves the outbox
+	cancel context.CancelFunc
+}
+
+// signal wakes the cursor waiting for room in its outbox.
+func (c *logCursor) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the cursor goroutine.
+func (c *logCursor) stop() {
+	c.cancel()
+}
+
+// startCursor copies log entries from offset on into outbox, keeping the ones accepts takes,
+// until the cursor or the topic is stopped.
+func (t *Topic) startCursor(offset int64, outbox queue.MessageQueue, accepts func(*types.Message) bool) *logCursor {
+	ctx, cancel := context.WithCancel(t.ctx)
+	c := &logCursor{wake: make(chan struct{}, 1), cancel: cancel}
+	go t.follow(ctx, c, offset, outbox, accepts)
+	return c
+}
+
+// follow runs a cursor. it waits for new entries at the end of the log
+// and for room whenever outbox is full. expired messages are skipped.
+func (t *Topic) follow(ctx context.Context, c *logCursor, offset int64, outbox queue.MessageQueue, accepts func(*types.Message) bool) {
+	for {
+		batch, appended := t.log.read(offset)
+		if len(batch) == 0 {
+			select {
+			case <-appended:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		for _, msg := range batch {
+			for outbox.Full() {
+				select {
+				case <-c.wake:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !msg.IsExpired(time.Now()) && accepts(msg) {
+				_ = outbox.Push(msg)
+			}
+			offset = msg.Offset + 1
+		}
+	}
+}
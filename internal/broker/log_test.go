@@ -0,0 +1,180 @@
+package broker
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func logBroker(t *testing.T, cfg BrokerConfig, topic TopicConfig) *Broker {
+	t.Helper()
+	topic.Mode = ModeLog
+	cfg.MaxQueueSize = 100
+	cfg.Topics = map[string]TopicConfig{"events": topic}
+	return newTestBroker(t, cfg)
+}
+
+// expectOffsets reads len(want) messages from sub and checks their offsets.
+func expectOffsets(t *testing.T, sub *Subscription, want ...int64) {
+	t.Helper()
+	for _, offset := range want {
+		if msg := next(t, sub); msg.Offset != offset {
+			t.Fatalf("got offset %d, want %d", msg.Offset, offset)
+		}
+	}
+	expectNone(t, sub, 50*time.Millisecond)
+}
+
+func TestLogReplayFromOffset(t *testing.T) {
+	b := logBroker(t, BrokerConfig{}, TopicConfig{})
+	publishAll(t, b, "events", 5)
+
+	cases := []struct {
+		offset string
+		want   []int64
+	}{
+		{OffsetEarliest, []int64{0, 1, 2, 3, 4}},
+		{"3", []int64{3, 4}},
+		{OffsetLatest, nil},
+		{"", nil},
+	}
+	for i, c := range cases {
+		sub, err := b.Subscribe("events", "reader"+string(rune('a'+i)), SubscribeOptions{Offset: c.offset})
+		if err != nil {
+			t.Fatalf("offset %q: %v", c.offset, err)
+		}
+		expectOffsets(t, sub, c.want...)
+	}
+
+	// every subscription reads the log on its own, nothing is consumed
+	topic, err := b.GetTopic("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := topic.Len(); n != 5 {
+		t.Fatalf("log retains %d messages, want 5", n)
+	}
+	publishAll(t, b, "events", 1)
+	for _, sub := range topic.Subscriptions {
+		if msg := next(t, sub); msg.Offset != 5 {
+			t.Fatalf("%s got offset %d, want 5", sub.ClientID, msg.Offset)
+		}
+	}
+}
+
+func TestLogResolveTime(t *testing.T) {
+	l := newMessageLog(0, 0, false)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		msg := &types.Message{Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if err := l.append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := map[time.Time]int64{
+		start.Add(-time.Hour):              0,
+		start.Add(1500 * time.Millisecond): 2,
+		start.Add(2 * time.Second):         2,
+		start.Add(time.Hour):               4,
+	}
+	for at, want := range cases {
+		got, err := l.resolve(at.Format(time.RFC3339Nano))
+		if err != nil || got != want {
+			t.Errorf("resolve(%v) = %d, %v, want %d", at.Sub(start), got, err, want)
+		}
+	}
+}
+
+func TestLogRejectsBadOffsets(t *testing.T) {
+	b := logBroker(t, BrokerConfig{}, TopicConfig{})
+	for _, offset := range []string{"-1", "yesterday"} {
+		if _, err := b.Subscribe("events", "reader", SubscribeOptions{Offset: offset}); err == nil {
+			t.Errorf("offset %q accepted", offset)
+		}
+	}
+	if _, err := b.Subscribe("orders", "reader", SubscribeOptions{Offset: OffsetEarliest}); err == nil {
+		t.Error("offset accepted on a queue topic")
+	}
+}
+
+func TestLogMaxRetained(t *testing.T) {
+	b := logBroker(t, BrokerConfig{}, TopicConfig{MaxRetained: 3})
+	publishAll(t, b, "events", 5)
+	sub, err := b.Subscribe("events", "reader", SubscribeOptions{Offset: OffsetEarliest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffsets(t, sub, 2, 3, 4)
+}
+
+func TestLogSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := NewBroker(BrokerConfig{
+		MaxQueueSize:    100,
+		CleanupInterval: time.Minute,
+		DataDir:         dir,
+		Topics:          map[string]TopicConfig{"events": {Mode: ModeLog}},
+	})
+	first.Start()
+	publishAll(t, first, "events", 3)
+	first.Stop()
+
+	b := logBroker(t, BrokerConfig{DataDir: dir}, TopicConfig{})
+	publishAll(t, b, "events", 1)
+	sub, err := b.Subscribe("events", "reader", SubscribeOptions{Offset: OffsetEarliest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOffsets(t, sub, 0, 1, 2, 3)
+}
+
+func TestCompactedLogSurvivesRestart(t *testing.T) {
+	cfg := BrokerConfig{
+		MaxQueueSize:       100,
+		CleanupInterval:    50 * time.Millisecond,
+		AckTimeout:         time.Minute,
+		RedeliveryInterval: time.Minute,
+		DataDir:            t.TempDir(),
+		Topics:             map[string]TopicConfig{"users": {Mode: ModeLog, Compact: true}},
+	}
+	b := NewBroker(cfg)
+	b.Start()
+	for i := 0; i < 30; i++ {
+		msg := &types.Message{Topic: "users", Key: fmt.Sprint("u", i%3), Payload: []byte(fmt.Sprint(i))}
+		if err := b.Publish("users", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	// replay returns key=payload@offset of every message kept by the log
+	replay := func(b *Broker, id string) []string {
+		sub, err := b.Subscribe("users", id, SubscribeOptions{Offset: "earliest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			select {
+			case msg := <-sub.MessageChannel:
+				got = append(got, fmt.Sprintf("%s=%s@%d", msg.Key, msg.Payload, msg.Offset))
+				b.Ack("users", sub.ID, msg.ID)
+			case <-time.After(100 * time.Millisecond):
+				return got
+			}
+		}
+	}
+	want := []string{"u0=27@27", "u1=28@28", "u2=29@29"}
+	if got := replay(b, "before"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay %v, want %v", got, want)
+	}
+	b.Stop()
+
+	b = newTestBroker(t, cfg)
+	if got := replay(b, "after"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay after restart %v, want %v", got, want)
+	}
+}
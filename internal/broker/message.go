@@ -1,6 +1,8 @@
 package broker
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"queuego/pkg/types"
 	"sync"
 	"time"
@@ -20,27 +22,56 @@ type BrokerMessage struct {
 	ExpiresAt     time.Time
 	AckDeadline   time.Time
 	State         MessageState
+	LastError     string // reason of the last failed delivery
 	mu            sync.Mutex
+
+	sub      *Subscription // holding the message in flight, nil while queued
+	retryDLQ bool          // dead-lettering failed, retried on the next redelivery pass; guarded by sub.mu
 }
 
-// NewBrokerMessage creates a new broker message with optional TTL
+// NewBrokerMessage creates a new broker message with optional TTL.
+// without a TTL it expires together with the message.
 func NewBrokerMessage(msg *types.Message, ttl time.Duration) *BrokerMessage {
 	bm := &BrokerMessage{
 		Msg:           msg,
 		DeliveryCount: 0,
 		State:         PENDING,
+		ExpiresAt:     msg.ExpiresAt,
 	}
 	if ttl > 0 {
 		bm.ExpiresAt = time.Now().Add(ttl)
 	}
 	return bm
 }
-func (bm *BrokerMessage) MarkDelivered() {
+
+// defaultAckTimeout is used when no ack timeout is configured.
+const defaultAckTimeout = 30 * time.Second
+
+// MarkDelivered records a delivery attempt and starts a new ack deadline.
+func (bm *BrokerMessage) MarkDelivered(ackTimeout time.Duration) {
+	if ackTimeout <= 0 {
+		ackTimeout = defaultAckTimeout
+	}
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 	bm.State = DELIVERED
 	bm.DeliveryCount++
-	bm.AckDeadline = time.Now().Add(30 * time.Second)
+	bm.AckDeadline = time.Now().Add(ackTimeout)
+}
+
+// MarkPending stops the ack deadline of a message being sent again,
+// until MarkDelivered starts a new one.
+func (bm *BrokerMessage) MarkPending() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.State = PENDING
+}
+
+// Pending reports whether the message waits for a delivery attempt to start its ack deadline.
+func (bm *BrokerMessage) Pending() bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.State == PENDING
 }
 
 // ack marks the message as acknowledged.
@@ -50,6 +81,27 @@ func (bm *BrokerMessage) Ack() {
 	bm.State = ACKNOWLEDGED
 }
 
+// RetryAt schedules the next delivery attempt of an unacknowledged message.
+func (bm *BrokerMessage) RetryAt(at time.Time) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.AckDeadline = at
+}
+
+// Attempts returns how many times the message has been delivered.
+func (bm *BrokerMessage) Attempts() int {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.DeliveryCount
+}
+
+// IsDue reports whether a delivered message missed its ack deadline.
+func (bm *BrokerMessage) IsDue(now time.Time) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.State == DELIVERED && now.After(bm.AckDeadline)
+}
+
 // isExpired checks if the message has expired.
 func (bm *BrokerMessage) IsExpired() bool {
 	if bm.ExpiresAt.IsZero() {
@@ -57,3 +109,15 @@ func (bm *BrokerMessage) IsExpired() bool {
 	}
 	return time.Now().After(bm.ExpiresAt)
 }
+
+// reasonExpired is recorded as the last error of messages that outlived their TTL.
+const reasonExpired = "expired"
+
+// newMessageID generates a random hex identifier for messages published without one.
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return hex.EncodeToString([]byte(time.Now().String()))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+// publishKeyed publishes n messages for each key, payloads counting up per key.
+func publishKeyed(t *testing.T, b *Broker, topic string, keys []string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		for _, key := range keys {
+			msg := &types.Message{Topic: topic, Key: key, Payload: []byte(fmt.Sprint(i))}
+			if err := b.Publish(topic, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func partitionedBroker(t *testing.T, partitions int) *Broker {
+	t.Helper()
+	return newTestBroker(t, BrokerConfig{
+		MaxQueueSize: 100,
+		Topics:       map[string]TopicConfig{"orders": {Partitions: partitions}},
+	})
+}
+
+func TestKeyedMessagesKeepTheirPartition(t *testing.T) {
+	b := partitionedBroker(t, 4)
+	sub, err := b.Subscribe("orders", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"alice", "bob", "carol", "dave", "erin"}
+	publishKeyed(t, b, "orders", keys, 5)
+
+	partition := make(map[string]int)
+	count := make(map[string]int)
+	for i := 0; i < len(keys)*5; i++ {
+		msg := next(t, sub)
+		if p, ok := partition[msg.Key]; ok && p != msg.Partition {
+			t.Fatalf("key %s in partitions %d and %d", msg.Key, p, msg.Partition)
+		}
+		partition[msg.Key] = msg.Partition
+		if got := string(msg.Payload); got != fmt.Sprint(count[msg.Key]) {
+			t.Fatalf("key %s: got message %s, want %d", msg.Key, got, count[msg.Key])
+		}
+		count[msg.Key]++
+	}
+}
+
+func TestUnkeyedMessagesSpreadOverPartitions(t *testing.T) {
+	b := partitionedBroker(t, 4)
+	sub, err := b.Subscribe("orders", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "orders", 8)
+
+	perPartition := make(map[int]int)
+	for i := 0; i < 8; i++ {
+		perPartition[next(t, sub).Partition]++
+	}
+	for p := 0; p < 4; p++ {
+		if perPartition[p] != 2 {
+			t.Fatalf("partitions received %v, want 2 messages each", perPartition)
+		}
+	}
+}
+
+func TestGroupMembersOwnPartitions(t *testing.T) {
+	b := partitionedBroker(t, 4)
+	a, err := b.Subscribe("orders", "a", SubscribeOptions{Group: "billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.Subscribe("orders", "c", SubscribeOptions{Group: "billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	publishKeyed(t, b, "orders", keys, 3)
+
+	member := make(map[string]*Subscription)
+	for i := 0; i < len(keys)*3; i++ {
+		var msg *types.Message
+		var sub *Subscription
+		select {
+		case msg = <-a.MessageChannel:
+			sub = a
+		case msg = <-c.MessageChannel:
+			sub = c
+		case <-time.After(time.Second):
+			t.Fatalf("group received %d of %d messages", i, len(keys)*3)
+		}
+		if m, ok := member[msg.Key]; ok && m != sub {
+			t.Fatalf("key %s consumed by both members", msg.Key)
+		}
+		member[msg.Key] = sub
+		if err := b.Ack("orders", sub.ID, msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// once a member leaves, the other owns every partition
+	b.Unsubscribe(c.ID)
+	publishKeyed(t, b, "orders", keys, 1)
+	for range keys {
+		msg := next(t, a)
+		if err := b.Ack("orders", a.ID, msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
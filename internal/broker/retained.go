@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"queuego/internal/storage"
+	"queuego/pkg/types"
+	"sync"
+)
+
+// retainedStore keeps the last retained message of each topic, so subscribers
+// to config or status topics receive the current value as soon as they join.
+type retainedStore struct {
+	msgs  map[string]*types.Message // topic -> last retained message
+	store *storage.FileStorage      // nil keeps retained messages in memory only
+	mu    sync.Mutex
+}
+
+func newRetainedStore(store *storage.FileStorage) *retainedStore {
+	return &retainedStore{
+		msgs:  make(map[string]*types.Message),
+		store: store,
+	}
+}
+
+// load restores the retained messages persisted before a restart.
+func (r *retainedStore) load() error {
+	if r.store == nil {
+		return nil
+	}
+	msgs, err := r.store.All()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range msgs {
+		// records are in write order, the last one of a topic is its current value
+		r.msgs[msg.Topic] = msg
+	}
+	return nil
+}
+
+// get returns the retained message of topic, or nil.
+func (r *retainedStore) get(topic string) *types.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.msgs[topic]
+}
+
+// set makes msg the retained message of its topic, replacing the previous one.
+func (r *retainedStore) set(msg *types.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.store != nil {
+		if err := r.store.Append(msg); err != nil {
+			return err
+		}
+		if old, ok := r.msgs[msg.Topic]; ok && old.ID != msg.ID {
+			if err := r.store.Delete(old.ID); err != nil {
+				return err
+			}
+		}
+	}
+	r.msgs[msg.Topic] = msg
+	return nil
+}
+
+// clear drops the retained message of topic.
+func (r *retainedStore) clear(topic string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.msgs[topic]
+	if !ok {
+		return nil
+	}
+	if r.store != nil {
+		if err := r.store.Delete(old.ID); err != nil {
+			return err
+		}
+	}
+	delete(r.msgs, topic)
+	return nil
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func publishRetained(t *testing.T, b *Broker, topic, id, payload string, headers map[string]string) {
+	t.Helper()
+	msg := &types.Message{ID: id, Topic: topic, Payload: []byte(payload), Headers: headers, Retain: true}
+	if err := b.Publish(topic, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// liveSubscriber subscribes to topic so published messages do not wait in its queue
+// for the subscribers a test adds later.
+func liveSubscriber(t *testing.T, b *Broker, topic string) *Subscription {
+	t.Helper()
+	sub, err := b.Subscribe(topic, "live", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestRetainedMessageGoesToNewSubscribers(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	live := liveSubscriber(t, b, "status")
+	publishRetained(t, b, "status", "v1", "starting", nil)
+	publishRetained(t, b, "status", "v2", "ready", map[string]string{"region": "eu"})
+	receive(t, b, live, 2)
+
+	sub, err := b.Subscribe("status", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := next(t, sub); msg.ID != "v2" {
+		t.Fatalf("new subscriber got %s, want the last retained value v2", msg.ID)
+	}
+	expectNone(t, sub, 50*time.Millisecond)
+
+	other, err := b.Subscribe("status", "us", SubscribeOptions{Filter: "region = 'us'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, other, 50*time.Millisecond)
+
+	// a group gets the value once, not once per member
+	a, err := b.Subscribe("status", "a", SubscribeOptions{Group: "dashboards"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := next(t, a); msg.ID != "v2" {
+		t.Fatalf("group got %s, want v2", msg.ID)
+	}
+	c, err := b.Subscribe("status", "c", SubscribeOptions{Group: "dashboards"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, c, 50*time.Millisecond)
+}
+
+func TestRetainedMessageCleared(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	live := liveSubscriber(t, b, "status")
+	publishRetained(t, b, "status", "v1", "ready", nil)
+	receive(t, b, live, 1)
+	publishRetained(t, b, "status", "", "", nil)
+	expectNone(t, live, 50*time.Millisecond)
+	sub, err := b.Subscribe("status", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, sub, 50*time.Millisecond)
+
+	live = liveSubscriber(t, b, "config")
+	publishRetained(t, b, "config", "c1", "x", nil)
+	receive(t, b, live, 1)
+	if err := b.ClearRetained("config"); err != nil {
+		t.Fatal(err)
+	}
+	publishRetained(t, b, "mode", "m1", "x", nil)
+	if err := b.DeleteTopic("mode"); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"config", "mode"} {
+		sub, err := b.Subscribe(topic, "app", SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNone(t, sub, 50*time.Millisecond)
+	}
+}
+
+func TestRetainedMessageSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := NewBroker(BrokerConfig{MaxQueueSize: 10, CleanupInterval: time.Minute, DataDir: dir})
+	first.Start()
+	publishRetained(t, first, "status", "v1", "starting", nil)
+	publishRetained(t, first, "status", "v2", "ready", nil)
+	first.Stop()
+
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10, DataDir: dir})
+	sub, err := b.Subscribe("status", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := next(t, sub); msg.ID != "v2" || string(msg.Payload) != "ready" {
+		t.Fatalf("restored %s %q, want v2 ready", msg.ID, msg.Payload)
+	}
+}
@@ -0,0 +1,192 @@
+package broker
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"queuego/internal/storage"
+	"queuego/pkg/types"
+	"sync"
+	"time"
+)
+
+// scheduledItem is a message waiting for its delivery time.
+type scheduledItem struct {
+	msg *types.Message
+	at  time.Time
+	seq int64
+}
+
+// scheduleHeap implements heap.Interface, earliest delivery time first.
+type scheduleHeap []*scheduledItem
+
+func (h scheduleHeap) Len() int { return len(h) }
+
+func (h scheduleHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h scheduleHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *scheduleHeap) Push(x any) { *h = append(*h, x.(*scheduledItem)) }
+
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// scheduler holds delayed messages outside the topic queues and releases them
+// when they are due. with a store, pending messages survive restarts.
+type scheduler struct {
+	mu      sync.Mutex
+	items   scheduleHeap
+	seq     int64
+	store   *storage.FileStorage // nil = memory only
+	release func(*types.Message) error
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+func newScheduler(store *storage.FileStorage, release func(*types.Message) error) *scheduler {
+	return &scheduler{
+		items:   scheduleHeap{},
+		store:   store,
+		release: release,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// load restores the messages persisted before a restart.
+func (s *scheduler) load() error {
+	if s.store == nil {
+		return nil
+	}
+	msgs, err := s.store.All()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		at, err := time.Parse(time.RFC3339Nano, msg.Headers[types.HeaderDeliverAt])
+		if err != nil {
+			log.Printf("scheduled message %s has no valid delivery time, releasing now", msg.ID)
+			at = time.Now()
+		}
+		s.push(msg, at)
+	}
+	if len(msgs) > 0 {
+		log.Printf("restored %d scheduled messages", len(msgs))
+	}
+	return nil
+}
+
+// add schedules msg for delivery at the given time.
+func (s *scheduler) add(msg *types.Message, at time.Time) error {
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[types.HeaderDeliverAt] = at.UTC().Format(time.RFC3339Nano)
+	msg.Headers = headers
+
+	if s.store != nil {
+		if err := s.store.Append(msg); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.push(msg, at)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *scheduler) push(msg *types.Message, at time.Time) {
+	heap.Push(&s.items, &scheduledItem{msg: msg, at: at, seq: s.seq})
+	s.seq++
+}
+
+// Len returns the number of messages waiting for delivery.
+func (s *scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// run releases due messages until stopped.
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		next := s.releaseDue()
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// releaseDue publishes every due message and returns the time of the next one.
+func (s *scheduler) releaseDue() time.Time {
+	for {
+		s.mu.Lock()
+		if len(s.items) == 0 {
+			s.mu.Unlock()
+			return time.Time{}
+		}
+		item := s.items[0]
+		if item.at.After(time.Now()) {
+			s.mu.Unlock()
+			return item.at
+		}
+		heap.Pop(&s.items)
+		s.mu.Unlock()
+
+		if err := s.release(item.msg); errors.Is(err, errNoInbox) {
+			log.Printf("scheduled message %s dropped: %v", item.msg.ID, err)
+		} else if err != nil {
+			// topic is full, try again shortly
+			log.Printf("scheduled message %s for %s not released: %v", item.msg.ID, item.msg.Topic, err)
+			s.mu.Lock()
+			s.push(item.msg, time.Now().Add(time.Second))
+			s.mu.Unlock()
+			continue
+		}
+		if s.store != nil {
+			if err := s.store.Delete(item.msg.ID); err != nil {
+				log.Printf("scheduled message %s released but not removed from storage: %v", item.msg.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func TestScheduledMessagesReleasedInTimeOrder(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	sub, err := b.Subscribe("reminders", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	later := &types.Message{ID: "later"}
+	sooner := &types.Message{ID: "sooner"}
+	if err := b.Schedule("reminders", later, start.Add(150*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Schedule("reminders", sooner, start.Add(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if b.scheduler.Len() != 2 {
+		t.Fatalf("%d messages scheduled, want 2", b.scheduler.Len())
+	}
+
+	for _, want := range []string{"sooner", "later"} {
+		msg := next(t, sub)
+		if msg.ID != want {
+			t.Fatalf("released %s, want %s", msg.ID, want)
+		}
+		if msg.Headers[types.HeaderDeliverAt] == "" {
+			t.Errorf("message %s has no delivery time header", msg.ID)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("later message released after %v", elapsed)
+	}
+}
+
+func TestScheduledMessagesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := NewBroker(BrokerConfig{MaxQueueSize: 10, CleanupInterval: time.Minute, DataDir: dir})
+	first.Start()
+	if err := first.Schedule("reminders", &types.Message{ID: "kept"}, time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	first.Stop()
+
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10, DataDir: dir})
+	if b.scheduler.Len() != 1 {
+		t.Fatalf("%d messages restored, want 1", b.scheduler.Len())
+	}
+	sub, err := b.Subscribe("reminders", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := next(t, sub); msg.ID != "kept" {
+		t.Fatalf("released %s, want kept", msg.ID)
+	}
+
+	// released messages are removed from storage
+	eventually(t, "released message to leave storage", func() bool {
+		msgs, err := b.scheduler.store.All()
+		return err == nil && len(msgs) == 0
+	})
+}
@@ -1,8 +1,12 @@
 package broker
 
 import (
+	"context"
 	"errors"
+	"queuego/internal/queue"
 	"queuego/pkg/types"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -10,9 +14,31 @@ type Subscription struct {
 	ID             string
 	Topic          string
 	ClientID       string
+	Group          string // consumer group sharing the topic's messages, empty = own copy
 	MessageChannel chan *types.Message
 	Active         bool
 	Filter         func(*types.Message) bool
+	FilterExpr     string // expression Filter was compiled from
+	AckTimeout     time.Duration
+	Prefetch       int    // max unacknowledged messages, 0 = unlimited
+	StartOffset    string // where reading a log topic starts: earliest, latest, an offset or an RFC 3339 time
+	Durable        bool   // kept, detached, while its client is disconnected
+	Overflow       string // OverflowDrop or OverflowSpill, when the outbox is full
+	ConfirmWrites  bool   // ack deadlines start at Written rather than when a message is sent
+
+	inflight map[string]*BrokerMessage // messageID -> delivered but unacknowledged message
+	window   *window                   // prefetch credit, shared by the topics of a wildcard subscription
+	mu       sync.Mutex                // guards Active, Prefetch, inflight and closed
+	resendMu sync.Mutex                // serializes redeliveries with detach and close
+
+	outbox  queue.MessageQueue // messages waiting for this subscription, shared within a group
+	cancel  context.CancelFunc // stops the delivery loop
+	freed   func()             // called when a message leaves the outbox
+	stopped chan struct{}      // closed when the delivery loop returns
+	cursor  *logCursor         // fills outbox on log topics, nil for group members
+
+	sharedChannel bool // MessageChannel belongs to a wildcard subscription and is closed by it
+	closed        bool
 }
 
 // NewSubscription creates a new subscription with a buffered channel.
@@ -24,29 +50,437 @@ func NewSubscription(id, topic, clientID string, buffer int, filter func(*types.
 		MessageChannel: make(chan *types.Message, buffer),
 		Active:         true,
 		Filter:         filter,
+		inflight:       make(map[string]*BrokerMessage),
+		window:         newWindow(),
 	}
 }
 
-// send pushes a message to the subscriber channel with non-blocking logic.
-func (s *Subscription) Send(msg *types.Message, timeout time.Duration) error {
-	if !s.Active {
-		return errors.New("subscription inactive")
+// window counts the messages a subscription may still be sent unacknowledged.
+type window struct {
+	mu       sync.Mutex
+	prefetch int           // 0 = unlimited
+	credit   int           // messages that may still be sent when prefetch > 0
+	grown    chan struct{} // closed and replaced when credit is given back
+}
+
+func newWindow() *window {
+	return &window{grown: make(chan struct{})}
+}
+
+// set restarts the window with n credits, 0 = unlimited.
+func (w *window) set(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.prefetch = n
+	w.credit = n
+	w.wake()
+}
+
+// add changes the credit by n, waking the delivery loops waiting for it when it grows.
+func (w *window) add(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.credit += n
+	if n > 0 {
+		w.wake()
 	}
+}
 
-	if s.Filter != nil && !s.Filter(msg) {
-		return nil
+// wake releases the delivery loops waiting on grown. callers hold w.mu.
+func (w *window) wake() {
+	close(w.grown)
+	w.grown = make(chan struct{})
+}
+
+// take uses up one credit, reporting false when none is left.
+func (w *window) take() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.prefetch > 0 && w.credit <= 0 {
+		return false
+	}
+	w.credit--
+	return true
+}
+
+// open reports whether a message may be sent now, and returns a channel closed
+// once credit is given back.
+func (w *window) open() (bool, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.prefetch == 0 || w.credit > 0, w.grown
+}
+
+// SetPrefetch limits the subscription to n unacknowledged messages, 0 = unlimited.
+func (s *Subscription) SetPrefetch(n int) {
+	s.mu.Lock()
+	s.Prefetch = n
+	s.mu.Unlock()
+	s.window.set(n)
+}
+
+// AddCredit lets the subscription receive n more messages on top of its prefetch window.
+func (s *Subscription) AddCredit(n int) {
+	s.window.add(n)
+}
+
+// Accepts reports whether msg passes the subscription filter.
+func (s *Subscription) Accepts(msg *types.Message) bool {
+	return s.Filter == nil || s.Filter(msg)
+}
+
+// start runs the delivery loop that moves messages from outbox to MessageChannel.
+// freed is called each time a message leaves the outbox.
+func (s *Subscription) start(outbox queue.MessageQueue, freed func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.outbox = outbox
+	s.freed = freed
+	s.cancel = cancel
+	s.stopped = make(chan struct{})
+	go s.run(ctx, freed)
+}
+
+// run delivers outbox messages one at a time while the prefetch window has credit,
+// so a slow subscriber only holds up its own outbox.
+func (s *Subscription) run(ctx context.Context, freed func()) {
+	defer close(s.stopped)
+	for {
+		for {
+			open, grown := s.window.open()
+			if open {
+				break
+			}
+			select {
+			case <-grown:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		msg, err := s.outbox.Pop(ctx)
+		if err != nil {
+			return
+		}
+		if !s.window.take() {
+			// another topic of a wildcard subscription used the credit meanwhile
+			s.outbox.PushFront(msg)
+			continue
+		}
+		freed()
+		if err := s.send(ctx, msg); err != nil {
+			s.window.add(1)
+			s.outbox.PushFront(msg)
+			return
+		}
 	}
+}
+
+// send pushes a message to the subscriber channel, waiting until ctx is done.
+// delivered messages are tracked until acknowledged and use up one credit.
+// the ack deadline starts now, or at Written when the subscription confirms writes.
+func (s *Subscription) send(ctx context.Context, msg *types.Message) error {
+	bm := NewBrokerMessage(msg, 0)
+	bm.sub = s
+	if !s.ConfirmWrites {
+		bm.MarkDelivered(s.AckTimeout)
+	}
+	s.mu.Lock()
+	s.inflight[msg.ID] = bm
+	s.mu.Unlock()
 
 	select {
 	case s.MessageChannel <- msg:
 		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.inflight, msg.ID)
+		s.mu.Unlock()
+		return errors.New("subscription closed")
+	}
+}
+
+// settle stops tracking a message and gives its credit back. callers hold s.mu.
+func (s *Subscription) settle(msgID string) {
+	delete(s.inflight, msgID)
+	s.window.add(1)
+}
+
+// Ack marks a delivered message as acknowledged and stops tracking it.
+func (s *Subscription) Ack(msgID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bm, ok := s.inflight[msgID]
+	if !ok {
+		return false
+	}
+	bm.Ack()
+	s.settle(msgID)
+	return true
+}
+
+// NackOptions controls what happens to a rejected message.
+type NackOptions struct {
+	Delay      time.Duration // wait before redelivering, 0 = redeliver immediately
+	Reason     string        // recorded as the last error
+	DeadLetter bool          // skip redelivery and dead-letter the message
+}
+
+// Nack rejects a delivered message. the message is redelivered according to opts,
+// or returned so the caller can dead-letter it when opts asks for it or when it
+// already used maxDeliveries attempts.
+func (s *Subscription) Nack(msgID string, opts NackOptions, maxDeliveries int) (*BrokerMessage, error) {
+	s.mu.Lock()
+	bm, ok := s.inflight[msgID]
+	if !ok {
+		s.mu.Unlock()
+		return nil, errors.New("message not awaiting acknowledgement")
+	}
+	bm.LastError = opts.Reason
+	if opts.DeadLetter || (maxDeliveries > 0 && bm.Attempts() >= maxDeliveries) {
+		s.settle(msgID)
+		s.mu.Unlock()
+		return bm, nil
+	}
+	s.mu.Unlock()
+
+	if opts.Delay > 0 {
+		bm.RetryAt(time.Now().Add(opts.Delay))
+		return nil, nil
+	}
+
+	// redeliver now, or leave it due for the next redelivery pass
+	bm.RetryAt(time.Now())
+	s.resend(bm, 0)
+	return nil, nil
+}
+
+// Redeliver re-sends unacknowledged messages whose ack deadline has passed.
+// messages that already used maxDeliveries attempts, or whose dead-lettering failed
+// before, are dropped from tracking and returned so the caller can dead-letter them.
+func (s *Subscription) Redeliver(timeout time.Duration, maxDeliveries int) []*BrokerMessage {
+	now := time.Now()
+	var due, exhausted []*BrokerMessage
+	s.mu.Lock()
+	if !s.Active {
+		s.mu.Unlock()
+		return nil
+	}
+	for id, bm := range s.inflight {
+		if bm.retryDLQ {
+			s.settle(id)
+			exhausted = append(exhausted, bm)
+			continue
+		}
+		if !bm.IsDue(now) || bm.IsExpired() {
+			continue
+		}
+		if maxDeliveries > 0 && bm.Attempts() >= maxDeliveries {
+			if bm.LastError == "" {
+				bm.LastError = "ack timeout"
+			}
+			s.settle(id)
+			exhausted = append(exhausted, bm)
+			continue
+		}
+		due = append(due, bm)
+	}
+	s.mu.Unlock()
+	sortByTimestamp(due)
+
+	for _, bm := range due {
+		if !s.resend(bm, timeout) {
+			return exhausted
+		}
+	}
+	return exhausted
+}
+
+// resend delivers bm again, unless the subscription was detached or closed, or bm
+// was settled, since bm was picked. it waits up to timeout for room in MessageChannel,
+// or not at all when timeout is 0, and reports false when the channel stayed full.
+func (s *Subscription) resend(bm *BrokerMessage, timeout time.Duration) bool {
+	s.resendMu.Lock()
+	defer s.resendMu.Unlock()
+	s.mu.Lock()
+	current := s.Active && !s.closed && s.inflight[bm.Msg.ID] == bm
+	s.mu.Unlock()
+	if !current {
+		return true
+	}
+
+	if timeout == 0 {
+		select {
+		case s.MessageChannel <- bm.Msg:
+			s.sent(bm)
+		default:
+		}
+		return true
+	}
+	select {
+	case s.MessageChannel <- bm.Msg:
+		s.sent(bm)
+		return true
 	case <-time.After(timeout):
-		return errors.New("send to subscription timed out")
+		return false
 	}
 }
 
-// close closes the subscription and cleans up resources.
-func (s *Subscription) Close() {
+// sent starts the ack deadline of a message put in MessageChannel, or leaves it
+// pending until Written when the subscription confirms writes.
+func (s *Subscription) sent(bm *BrokerMessage) {
+	if s.ConfirmWrites {
+		bm.MarkPending()
+		return
+	}
+	bm.MarkDelivered(s.AckTimeout)
+}
+
+// Written starts the ack deadline of a pending message once it reached the client.
+// it reports false when the message is not in flight or its deadline already runs.
+func (s *Subscription) Written(msgID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, ok := s.inflight[msgID]
+	if !ok || !bm.Pending() {
+		return false
+	}
+	bm.MarkDelivered(s.AckTimeout)
+	return true
+}
+
+// RemoveExpired stops tracking in-flight messages that outlived their TTL and returns them.
+func (s *Subscription) RemoveExpired() []*BrokerMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*BrokerMessage
+	for id, bm := range s.inflight {
+		if bm.IsExpired() && !bm.retryDLQ {
+			bm.LastError = reasonExpired
+			s.settle(id)
+			expired = append(expired, bm)
+		}
+	}
+	return expired
+}
+
+// keep takes back a message whose dead-lettering failed, so the next redelivery pass
+// tries again. it reports false when the subscription was closed meanwhile.
+func (s *Subscription) keep(bm *BrokerMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	bm.retryDLQ = true
+	s.inflight[bm.Msg.ID] = bm
+	s.window.add(-1)
+	return true
+}
+
+// Unacked returns the messages still awaiting acknowledgement, oldest first.
+func (s *Subscription) Unacked() []*types.Message {
+	s.mu.Lock()
+	pending := make([]*BrokerMessage, 0, len(s.inflight))
+	for _, bm := range s.inflight {
+		pending = append(pending, bm)
+	}
+	s.mu.Unlock()
+	sortByTimestamp(pending)
+
+	msgs := make([]*types.Message, len(pending))
+	for i, bm := range pending {
+		msgs[i] = bm.Msg
+	}
+	return msgs
+}
+
+// detach pauses a durable subscription whose client went away. delivery stops and
+// the unacknowledged messages, including those not yet read from MessageChannel,
+// go back to the front of the outbox, which keeps filling until resume.
+func (s *Subscription) detach() {
+	s.mu.Lock()
+	if s.closed || !s.Active {
+		s.mu.Unlock()
+		return
+	}
 	s.Active = false
-	close(s.MessageChannel)
+	s.mu.Unlock()
+
+	s.cancel()
+	<-s.stopped
+	// wait for a redelivery in progress, later ones see the subscription inactive
+	s.resendMu.Lock()
+	if !s.sharedChannel {
+		for len(s.MessageChannel) > 0 {
+			<-s.MessageChannel
+		}
+	}
+	s.resendMu.Unlock()
+
+	unacked := s.Unacked()
+	s.mu.Lock()
+	s.inflight = make(map[string]*BrokerMessage)
+	s.window.set(s.Prefetch)
+	s.mu.Unlock()
+	for i := len(unacked) - 1; i >= 0; i-- {
+		s.outbox.PushFront(unacked[i])
+	}
+}
+
+// Detached reports whether the subscription is waiting for its client to come back.
+func (s *Subscription) Detached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && !s.Active
+}
+
+// resume restarts delivery of a detached subscription with a new prefetch window.
+func (s *Subscription) resume(prefetch int) {
+	s.SetPrefetch(prefetch)
+	s.setActive(true)
+	s.start(s.outbox, s.freed)
+}
+
+// setActive marks the subscription as receiving or waiting for its client.
+func (s *Subscription) setActive(active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Active = active
+}
+
+// close stops the delivery loop, closes the subscription and cleans up resources.
+// closing an already closed subscription does nothing.
+func (s *Subscription) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		<-s.stopped
+	}
+	s.setActive(false)
+	// a redelivery in progress must not send on the closed channel
+	s.resendMu.Lock()
+	defer s.resendMu.Unlock()
+	if !s.sharedChannel {
+		close(s.MessageChannel)
+		return
+	}
+	// the other topics of the wildcard subscription get the credit back
+	s.mu.Lock()
+	s.window.add(len(s.inflight))
+	s.mu.Unlock()
+}
+
+func sortByTimestamp(msgs []*BrokerMessage) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Msg.Timestamp.Before(msgs[j].Msg.Timestamp)
+	})
 }
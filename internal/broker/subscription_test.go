@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+// next reads one message from sub or fails after a second.
+func next(t *testing.T, sub *Subscription) *types.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.MessageChannel:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message delivered")
+	}
+	return nil
+}
+
+// expectNone fails if sub receives a message within d.
+func expectNone(t *testing.T, sub *Subscription, d time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-sub.MessageChannel:
+		t.Fatalf("unexpected delivery of %s", msg.ID)
+	case <-time.After(d):
+	}
+}
+
+func TestRedeliverAfterAckDeadline(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		AckTimeout:         50 * time.Millisecond,
+		RedeliveryInterval: 10 * time.Millisecond,
+	})
+	sub, err := b.Subscribe("events", "slow", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "events", 1)
+
+	first := next(t, sub)
+	again := next(t, sub)
+	if again.ID != first.ID {
+		t.Fatalf("redelivered %s, want %s", again.ID, first.ID)
+	}
+	if err := b.Ack("events", sub.ID, again.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, sub, 150*time.Millisecond)
+	if err := b.Ack("events", sub.ID, again.ID); err == nil {
+		t.Fatal("second ack of the same message succeeded")
+	}
+}
+
+func TestAckBeforeDeadlineStopsRedelivery(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		AckTimeout:         50 * time.Millisecond,
+		RedeliveryInterval: 10 * time.Millisecond,
+	})
+	sub, err := b.Subscribe("events", "fast", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "events", 3)
+
+	for i := 0; i < 3; i++ {
+		msg := next(t, sub)
+		if err := b.Ack("events", sub.ID, msg.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectNone(t, sub, 150*time.Millisecond)
+	if n := len(sub.Unacked()); n != 0 {
+		t.Fatalf("%d messages still unacknowledged", n)
+	}
+}
+
+func TestConfirmWritesDefersAckDeadline(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       10,
+		AckTimeout:         50 * time.Millisecond,
+		RedeliveryInterval: 10 * time.Millisecond,
+	})
+	sub, err := b.Subscribe("events", "slow", SubscribeOptions{ConfirmWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "events", 1)
+	msg := next(t, sub)
+	expectNone(t, sub, 150*time.Millisecond)
+
+	if err := b.Written("events", sub.ID, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Written("events", sub.ID, msg.ID); err == nil {
+		t.Fatal("second Written accepted")
+	}
+	if again := next(t, sub); again.ID != msg.ID {
+		t.Fatalf("redelivered %s, want %s", again.ID, msg.ID)
+	}
+	// the redelivery waits for its own write
+	expectNone(t, sub, 150*time.Millisecond)
+}
+
+// eventually polls cond until it holds or a second has passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPrefetchWindow(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	sub, err := b.Subscribe("events", "app", SubscribeOptions{Prefetch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "events", 5)
+
+	first := next(t, sub)
+	next(t, sub)
+	expectNone(t, sub, 100*time.Millisecond)
+
+	// every ack frees a slot in the window
+	if err := b.Ack("events", sub.ID, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	next(t, sub)
+	expectNone(t, sub, 100*time.Millisecond)
+
+	// credit lets more messages through without acks
+	if err := b.Credit("events", sub.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	next(t, sub)
+	next(t, sub)
+	if n := len(sub.Unacked()); n != 4 {
+		t.Fatalf("%d unacknowledged messages, want 4", n)
+	}
+	if _, err := b.Subscribe("events", "bad", SubscribeOptions{Prefetch: -1}); err == nil {
+		t.Fatal("negative prefetch accepted")
+	}
+}
+
+func TestWildcardPrefetchSharedByTopics(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 100})
+	sub, err := b.Subscribe("events.>", "app", SubscribeOptions{Prefetch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"events.a", "events.b", "events.c"} {
+		publishAll(t, b, topic, 3)
+	}
+
+	first := next(t, sub)
+	next(t, sub)
+	expectNone(t, sub, 100*time.Millisecond)
+
+	if err := b.Ack(first.Topic, sub.ID, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	next(t, sub)
+	expectNone(t, sub, 100*time.Millisecond)
+
+	if err := b.Credit("events.>", sub.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	next(t, sub)
+	next(t, sub)
+	expectNone(t, sub, 100*time.Millisecond)
+}
+
+func TestRedeliverWhileDetaching(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:       100,
+		AckTimeout:         time.Millisecond,
+		RedeliveryInterval: time.Millisecond,
+	})
+	sub, err := b.Subscribe("events", "away", SubscribeOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "events", 20)
+
+	// unacknowledged messages keep being redelivered while the client comes and goes
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		b.Detach(sub.ID)
+		if sub, err = b.Subscribe("events", "away", SubscribeOptions{Durable: true}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	seen := make(map[string]bool)
+	for {
+		select {
+		case msg := <-sub.MessageChannel:
+			if seen[msg.ID] {
+				continue // redelivered after its ack deadline
+			}
+			seen[msg.ID] = true
+			if err := b.Ack("events", sub.ID, msg.ID); err != nil {
+				t.Fatalf("ack %s: %v", msg.ID, err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if len(seen) != 20 {
+				t.Fatalf("received %d of 20 messages", len(seen))
+			}
+			return
+		}
+	}
+}
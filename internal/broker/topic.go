@@ -1,60 +1,440 @@
 package broker
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
 	"queuego/internal/queue"
 	"queuego/pkg/types"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// queue types a topic can be created with
+const (
+	QueueFIFO     = "fifo"
+	QueuePriority = "priority"
+)
+
+// overflow policies, applied to a subscriber whose outbox is full while
+// another subscriber of the topic can still take the message
+const (
+	OverflowDrop  = "drop"  // the subscriber misses the message
+	OverflowSpill = "spill" // the outbox grows past MaxQueueSize
+
+	OverflowDropOldest = "drop-oldest" // backlog only: the oldest waiting message makes room
+)
+
+// TopicConfig holds per-topic settings. zero values fall back to the broker defaults.
+type TopicConfig struct {
+	MaxQueueSize    int
+	QueueType       string // QueueFIFO or QueuePriority
+	MaxDeliveries   int    // delivery attempts before a message is dead-lettered, 0 = unlimited
+	DeadLetterTopic string // defaults to "<topic>.dlq"
+
+	MessageTTL        time.Duration // default lifetime of messages published without a TTL, 0 = forever
+	DeadLetterExpired *bool         // move expired messages to the dead-letter topic instead of dropping them, nil = broker default
+
+	DedupWindow time.Duration // how long producer-assigned message IDs are remembered, 0 = no deduplication
+	Partitions  int           // independently ordered queues, each up to MaxQueueSize; 0 or 1 = unpartitioned
+
+	Mode        string        // ModeQueue or ModeLog
+	Retention   time.Duration // how long a log topic keeps messages, 0 = forever
+	MaxRetained int           // max messages a log topic keeps, 0 = unlimited
+	Compact     bool          // log topic keeps only the latest message per key, like a changelog
+
+	MaxMessageSize int    // max payload bytes of a published message, 0 = unlimited
+	Overflow       string // OverflowDrop or OverflowSpill, default policy of subscribers that fall behind
+
+	MaxBacklog      int    // max messages kept for a detached durable subscriber, 0 = MaxQueueSize
+	BacklogOverflow string // OverflowDrop or OverflowDropOldest, when a detached subscriber's backlog is full
+}
+
 type Topic struct {
 	Name          string
-	Queue         *queue.Queue
+	Config        TopicConfig
+	Partitions    []queue.MessageQueue // messages with the same key always share a partition
 	Subscriptions map[string]*Subscription
+	groups        map[string]*consumerGroup
+	dedup         *dedupWindow
+	log           *messageLog    // retained messages of a log topic, nil in queue mode
+	retained      *types.Message // last value delivered first to new subscribers, may be nil
 	mu            sync.RWMutex
 
 	MessageCount    int
 	SubscriberCount int
 	LastPublish     time.Time
+	DroppedCount    int // messages a subscriber missed because its outbox was full
 
-	stopChan chan struct{}
+	nextPartition atomic.Uint32   // round-robin partition for messages without a key
+	wakes         []chan struct{} // per partition, signalled when subscribers join or regain capacity
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
-// NewTopic creates a new topic.
-func NewTopic(name string, maxQueueSize int) *Topic {
+// NewTopic creates a new topic with one distributor per partition.
+// log topics have a single partition and feed each subscription from the log instead.
+func NewTopic(name string, cfg TopicConfig) *Topic {
+	if cfg.Partitions < 1 || cfg.Mode == ModeLog {
+		cfg.Partitions = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	t := &Topic{
 		Name:          name,
-		Queue:         queue.NewQueue(maxQueueSize),
+		Config:        cfg,
+		Partitions:    make([]queue.MessageQueue, cfg.Partitions),
 		Subscriptions: make(map[string]*Subscription),
-		stopChan:      make(chan struct{}),
+		groups:        make(map[string]*consumerGroup),
+		dedup:         newDedupWindow(cfg.DedupWindow),
+		wakes:         make([]chan struct{}, cfg.Partitions),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	if cfg.Mode == ModeLog {
+		t.log = newMessageLog(cfg.Retention, cfg.MaxRetained, cfg.Compact)
+	}
+	for p := range t.Partitions {
+		t.Partitions[p] = newQueue(cfg)
+		t.wakes[p] = make(chan struct{}, 1)
+		if t.log == nil {
+			go t.distribute(p)
+		}
 	}
-	go t.distribute()
 	return t
 }
 
-// AddSubscription adds a subscriber to the topic.
-func (t *Topic) AddSubscription(sub *Subscription) {
+// partitioned reports whether the topic has more than one partition.
+func (t *Topic) partitioned() bool {
+	return len(t.Partitions) > 1
+}
+
+// partitionFor picks the partition of a message: a hash of its key,
+// or round-robin when it has none.
+func (t *Topic) partitionFor(msg *types.Message) int {
+	n := len(t.Partitions)
+	if n == 1 {
+		return 0
+	}
+	if msg.Key == "" {
+		return int(t.nextPartition.Add(1) % uint32(n))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(msg.Key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// requeue puts messages back at the front of their partitions, keeping their order.
+func (t *Topic) requeue(msgs []*types.Message) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		t.Partitions[msgs[i].Partition%len(t.Partitions)].PushFront(msgs[i])
+	}
+}
+
+// Len returns the number of messages queued across all partitions,
+// or retained by a log topic.
+func (t *Topic) Len() int {
+	if t.log != nil {
+		return t.log.len()
+	}
+	n := 0
+	for _, q := range t.Partitions {
+		n += q.Len()
+	}
+	return n
+}
+
+// newQueue builds the queue implementation selected by the topic config.
+func newQueue(cfg TopicConfig) queue.MessageQueue {
+	if cfg.QueueType == QueuePriority {
+		return queue.NewPriorityQueue(cfg.MaxQueueSize)
+	}
+	return queue.NewQueue(cfg.MaxQueueSize)
+}
+
+// AddSubscription adds a subscriber to the topic, replacing any previous one with the same ID.
+// members of a consumer group must all use the same filter.
+func (t *Topic) AddSubscription(sub *Subscription) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if g, ok := t.groups[sub.Group]; ok && !g.compatible(sub) {
+		return errors.New("group " + sub.Group + " already uses a different filter")
+	}
+	var offset int64
+	if t.log != nil {
+		var err error
+		if offset, err = t.log.resolve(sub.StartOffset); err != nil {
+			return err
+		}
+	} else if sub.StartOffset != "" {
+		return errors.New("topic " + t.Name + " is not a log topic, offsets are not supported")
+	}
+	if old, ok := t.Subscriptions[sub.ID]; ok && old != sub {
+		old.Close()
+		if old.cursor != nil {
+			old.cursor.stop()
+		}
+		if g, ok := t.groups[old.Group]; ok {
+			g.remove(old.ID)
+		}
+	}
 	t.Subscriptions[sub.ID] = sub
 	t.SubscriberCount = len(t.Subscriptions)
+
+	// outboxes order messages the same way as the topic queue
+	outbox := newQueue(t.Config)
+	if sub.Group != "" {
+		g, ok := t.groups[sub.Group]
+		if !ok {
+			// members of a partitioned topic's group keep their own outbox
+			// so each partition, and thus each key, is consumed by one member
+			var shared queue.MessageQueue
+			if !t.partitioned() {
+				shared = newQueue(t.Config)
+			}
+			g = newConsumerGroup(sub.Group, shared)
+			g.overflow = sub.Overflow
+			t.groups[sub.Group] = g
+		}
+		if g.outbox != nil {
+			outbox = g.outbox
+		}
+		if !ok {
+			// a group receives the retained message once, when it is formed,
+			// and on a log topic reads from the offset its first member asked for
+			t.pushRetained(outbox, sub.Accepts)
+			if t.log != nil {
+				g.cursor = t.startCursor(offset, g.outbox, sub.Accepts)
+			}
+		}
+		freed := t.signal
+		if g.cursor != nil {
+			freed = g.cursor.signal
+		}
+		sub.start(outbox, freed)
+		g.add(sub)
+		g.rebalance()
+	} else if t.log != nil {
+		t.pushRetained(outbox, sub.Accepts)
+		sub.cursor = t.startCursor(offset, outbox, sub.Accepts)
+		sub.start(outbox, sub.cursor.signal)
+	} else {
+		t.pushRetained(outbox, sub.Accepts)
+		sub.start(outbox, t.signal)
+	}
+	t.signal()
+	return nil
+}
+
+// setRetained replaces the topic's retained message, nil clears it.
+func (t *Topic) setRetained(msg *types.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retained = msg
+}
+
+// pushRetained queues the retained message for a new subscriber if it wants it
+// and it has not expired. callers hold t.mu.
+func (t *Topic) pushRetained(outbox queue.MessageQueue, accepts func(*types.Message) bool) {
+	if t.retained == nil || t.retained.IsExpired(time.Now()) || !accepts(t.retained) {
+		return
+	}
+	_ = outbox.Push(t.retained)
 }
 
 // RemoveSubscription removes a subscriber from the topic.
+// its unacknowledged messages are handed to the remaining members of its group,
+// or go back to the queue, along with everything still waiting in the outbox,
+// if it was the last subscriber so the next one receives them.
+// on log topics the messages stay in the log for the next subscriber to replay.
 func (t *Topic) RemoveSubscription(subID string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if sub, ok := t.Subscriptions[subID]; ok {
-		sub.Close()
-		delete(t.Subscriptions, subID)
+	sub, ok := t.Subscriptions[subID]
+	if !ok {
+		return
 	}
+	sub.Close()
+	if sub.cursor != nil {
+		sub.cursor.stop()
+	}
+	delete(t.Subscriptions, subID)
 	t.SubscriberCount = len(t.Subscriptions)
+	t.signal()
+
+	unacked := sub.Unacked()
+	if g, ok := t.groups[sub.Group]; ok {
+		g.remove(subID)
+		if len(g.members) == 0 {
+			if g.cursor != nil {
+				g.cursor.stop()
+			}
+			delete(t.groups, sub.Group)
+		} else if g.outbox != nil {
+			for i := len(unacked) - 1; i >= 0; i-- {
+				g.outbox.PushFront(unacked[i])
+			}
+			return
+		} else {
+			g.rebalance()
+			g.requeue(append(unacked, drain(sub.outbox)...))
+			return
+		}
+	}
+
+	if len(t.Subscriptions) == 0 && t.log == nil {
+		pending := append(unacked, drain(sub.outbox)...)
+		if len(pending) > 0 {
+			log.Printf("topic %s: returning %d messages of %s to the queue", t.Name, len(pending), subID)
+		}
+		t.requeue(pending)
+	}
+}
+
+// Detach pauses a durable subscription whose client disconnected.
+// the topic keeps filling its outbox, as a backlog bounded by MaxBacklog, until the client comes back.
+func (t *Topic) Detach(subID string) {
+	sub, ok := t.GetSubscription(subID)
+	if !ok || !sub.Durable {
+		return
+	}
+	sub.detach()
+	t.signal()
+}
+
+// resume restarts a detached subscription when the client subscribes again with the same
+// group and filter. it continues where it left off, so a log topic offset is not applied again.
+func (t *Topic) resume(subID string, opts SubscribeOptions) (*Subscription, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sub, ok := t.Subscriptions[subID]
+	if !ok || !sub.Detached() || sub.Group != opts.Group || sub.FilterExpr != opts.Filter {
+		return nil, false
+	}
+	sub.resume(opts.Prefetch)
+	t.signal()
+	return sub, true
+}
+
+// GetSubscription returns a subscription by ID.
+func (t *Topic) GetSubscription(subID string) (*Subscription, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	sub, ok := t.Subscriptions[subID]
+	return sub, ok
 }
 
-// publish adds a message to the queue.
+// Nack rejects a message delivered to one of the topic's subscriptions.
+// it returns the message when it has to be dead-lettered.
+func (t *Topic) Nack(subID, msgID string, opts NackOptions) (*BrokerMessage, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	sub, ok := t.Subscriptions[subID]
+	if !ok {
+		return nil, errors.New("subscription not found")
+	}
+	return sub.Nack(msgID, opts, t.Config.MaxDeliveries)
+}
+
+// Redeliver re-sends messages that were not acknowledged in time and returns
+// the ones that ran out of delivery attempts.
+func (t *Topic) Redeliver() []*BrokerMessage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var exhausted []*BrokerMessage
+	for _, sub := range t.Subscriptions {
+		exhausted = append(exhausted, sub.Redeliver(50*time.Millisecond, t.Config.MaxDeliveries)...)
+	}
+	return exhausted
+}
+
+// RemoveExpired drops the queued and in-flight messages that outlived their TTL and returns them.
+func (t *Topic) RemoveExpired() []*BrokerMessage {
+	var expired []*BrokerMessage
+	for _, q := range t.Partitions {
+		for _, msg := range q.RemoveExpired(time.Now()) {
+			bm := NewBrokerMessage(msg, 0)
+			bm.LastError = reasonExpired
+			expired = append(expired, bm)
+		}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, sub := range t.Subscriptions {
+		expired = append(expired, sub.RemoveExpired()...)
+	}
+	return expired
+}
+
+// keep takes back a message that could not be dead-lettered: into the subscription
+// that had it in flight, or at the front of its partition when it expired queued.
+func (t *Topic) keep(bm *BrokerMessage) {
+	if bm.sub != nil {
+		if !bm.sub.keep(bm) {
+			log.Printf("topic %s: message %s lost, subscription %s closed before it could be dead-lettered", t.Name, bm.Msg.ID, bm.sub.ID)
+		}
+		return
+	}
+	if len(t.Partitions) > 0 {
+		t.Partitions[bm.Msg.Partition%len(t.Partitions)].PushFront(bm.Msg)
+	}
+}
+
+// publish adds a message to the queue of its partition, or appends it to the log.
 func (t *Topic) Publish(msg *types.Message) error {
-	if err := t.Queue.Push(msg); err != nil {
-		return err
+	return t.publish(msg, false)
+}
+
+// checkSize rejects a message whose payload exceeds the topic's max message size.
+func (t *Topic) checkSize(msg *types.Message) error {
+	if t.Config.MaxMessageSize > 0 && len(msg.Payload) > t.Config.MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte limit of topic %s", len(msg.Payload), t.Config.MaxMessageSize, t.Name)
+	}
+	return nil
+}
+
+// room picks the partitions of msgs and reports an error unless they all fit,
+// so a transaction is rejected as a whole before any of its messages is queued.
+func (t *Topic) room(msgs []*types.Message) error {
+	if t.log != nil || t.Config.MaxQueueSize <= 0 {
+		for _, msg := range msgs {
+			msg.Partition = t.partitionFor(msg)
+		}
+		return nil
+	}
+	counts := make([]int, len(t.Partitions))
+	for _, msg := range msgs {
+		msg.Partition = t.partitionFor(msg)
+		counts[msg.Partition]++
+	}
+	for p, n := range counts {
+		if n > 0 && t.Partitions[p].Len()+n > t.Config.MaxQueueSize {
+			return errors.New("topic " + t.Name + " is full")
+		}
+	}
+	return nil
+}
+
+// publish adds msg to the topic. reserved messages already got their partition
+// and room from room, and are queued regardless of the max size.
+func (t *Topic) publish(msg *types.Message, reserved bool) error {
+	if msg.ExpiresAt.IsZero() && t.Config.MessageTTL > 0 {
+		msg.ExpiresAt = time.Now().Add(t.Config.MessageTTL)
+	}
+	if t.log != nil {
+		if err := t.log.append(msg); err != nil {
+			return err
+		}
+	} else if reserved {
+		t.Partitions[msg.Partition].Append(msg)
+	} else {
+		msg.Partition = t.partitionFor(msg)
+		if err := t.Partitions[msg.Partition].Push(msg); err != nil {
+			return err
+		}
 	}
 	t.mu.Lock()
 	t.MessageCount++
@@ -63,31 +443,141 @@ func (t *Topic) Publish(msg *types.Message) error {
 	return nil
 }
 
-// distribute continuously reads from queue and pushes to subscribers.
-func (t *Topic) distribute() {
-	for {
+// signal wakes the distributors without blocking.
+func (t *Topic) signal() {
+	for _, wake := range t.wakes {
 		select {
-		case <-t.stopChan:
-			return
+		case wake <- struct{}{}:
 		default:
-			msg, err := t.Queue.Pop()
-			if err != nil {
-				time.Sleep(10 * time.Millisecond) // avoid busy loop
+		}
+	}
+}
+
+// distribute reads from partition p and pushes to subscribers.
+// it sleeps until a message is published or a subscriber can take one.
+func (t *Topic) distribute(p int) {
+	q, wake := t.Partitions[p], t.wakes[p]
+	for {
+		// keep messages queued until someone can receive them
+		t.mu.RLock()
+		idle := len(t.Subscriptions) == 0
+		t.mu.RUnlock()
+		if idle {
+			select {
+			case <-wake:
 				continue
+			case <-t.ctx.Done():
+				return
 			}
+		}
+
+		msg, err := q.Pop(t.ctx)
+		if err != nil {
+			return // topic closed
+		}
 
-			t.mu.RLock()
-			for _, sub := range t.Subscriptions {
-				_ = sub.Send(msg, 50*time.Millisecond) // ignore send errors for slow subscribers
+		// put the message back until some outbox has room for it.
+		// the write lock keeps other partitions from filling the outboxes in between
+		t.mu.Lock()
+		if len(t.Subscriptions) == 0 || !t.ready(msg) {
+			t.mu.Unlock()
+			q.PushFront(msg)
+			select {
+			case <-wake:
+				continue
+			case <-t.ctx.Done():
+				return
+			}
+		}
+		for _, sub := range t.Subscriptions {
+			if sub.Group == "" && sub.Accepts(msg) {
+				t.offer(sub.outbox, sub.Overflow, sub.Detached(), msg, "subscription "+sub.ID)
+			}
+		}
+		for _, g := range t.groups {
+			if g.accepts(msg) {
+				t.offer(g.outboxFor(msg.Partition), g.overflow, g.detached(msg.Partition), msg, "group "+g.name)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// ready reports whether msg can leave its partition: no connected subscriber wants it,
+// or at least one ungrouped subscriber or group interested in it has room in its outbox.
+// the topic moves at the pace of its fastest subscriber, the others apply their
+// overflow policy, and detached subscribers never hold it up. callers hold t.mu.
+func (t *Topic) ready(msg *types.Message) bool {
+	wanted := false
+	for _, sub := range t.Subscriptions {
+		if sub.Group == "" && sub.Accepts(msg) && !sub.Detached() {
+			if !sub.outbox.Full() {
+				return true
 			}
-			t.mu.RUnlock()
+			wanted = true
 		}
 	}
+	for _, g := range t.groups {
+		if g.accepts(msg) && !g.detached(msg.Partition) {
+			if !g.outboxFor(msg.Partition).Full() {
+				return true
+			}
+			wanted = true
+		}
+	}
+	return !wanted
+}
+
+// offer adds msg to an outbox, or applies the overflow policy when it is full.
+// the outbox of a detached subscriber is a backlog with its own size and policy.
+// callers hold t.mu.
+func (t *Topic) offer(outbox queue.MessageQueue, overflow string, detached bool, msg *types.Message, owner string) {
+	limit := t.Config.MaxQueueSize
+	if detached {
+		overflow = t.Config.BacklogOverflow
+		if t.Config.MaxBacklog > 0 {
+			limit = t.Config.MaxBacklog
+		}
+	}
+	if limit <= 0 || outbox.Len() < limit || (overflow == OverflowSpill && !detached) {
+		outbox.Append(msg)
+		return
+	}
+	if overflow == OverflowDropOldest {
+		if oldest, err := outbox.TryPop(); err == nil {
+			outbox.Append(msg)
+			msg = oldest
+		}
+	}
+	t.DroppedCount++
+	log.Printf("topic %s: outbox of %s is full, message %s dropped", t.Name, owner, msg.ID)
+}
+
+// drain empties a queue and returns its messages in order.
+func drain(q queue.MessageQueue) []*types.Message {
+	var msgs []*types.Message
+	for {
+		msg, err := q.TryPop()
+		if err != nil {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// Credit adds n credits to a subscription's prefetch window.
+func (t *Topic) Credit(subID string, n int) error {
+	sub, ok := t.GetSubscription(subID)
+	if !ok {
+		return errors.New("subscription not found")
+	}
+	sub.AddCredit(n)
+	return nil
 }
 
 // close stops topic distribution and cleans up subscriptions.
 func (t *Topic) Close() {
-	close(t.stopChan)
+	t.cancel()
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func newTestBroker(t *testing.T, cfg BrokerConfig) *Broker {
+	t.Helper()
+	if cfg.CleanupInterval == 0 {
+		cfg.CleanupInterval = time.Minute
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = time.Minute
+	}
+	if cfg.RedeliveryInterval == 0 {
+		cfg.RedeliveryInterval = time.Minute
+	}
+	b := NewBroker(cfg)
+	b.Start()
+	t.Cleanup(b.Stop)
+	return b
+}
+
+// publishAll publishes n messages, retrying while the topic queue is momentarily full.
+func publishAll(t *testing.T, b *Broker, topic string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			err := b.Publish(topic, &types.Message{Topic: topic, Payload: []byte(fmt.Sprint(i))})
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("publish %d: %v", i, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// receive reads n messages from sub, acknowledging each.
+func receive(t *testing.T, b *Broker, sub *Subscription, n int) int {
+	t.Helper()
+	got := 0
+	for got < n {
+		select {
+		case msg := <-sub.MessageChannel:
+			b.Ack(sub.Topic, sub.ID, msg.ID)
+			got++
+		case <-time.After(2 * time.Second):
+			return got
+		}
+	}
+	return got
+}
+
+func TestSlowSubscriberDoesNotStallTopic(t *testing.T) {
+	for _, overflow := range []string{OverflowDrop, OverflowSpill} {
+		t.Run(overflow, func(t *testing.T) {
+			b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10, Overflow: overflow})
+			fast, err := b.Subscribe("events", "fast", SubscribeOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Subscribe("events", "slow", SubscribeOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan int)
+			go func() { done <- receive(t, b, fast, 300) }()
+			publishAll(t, b, "events", 300)
+			if got := <-done; got != 300 {
+				t.Fatalf("fast subscriber received %d of 300 messages", got)
+			}
+
+			topic, _ := b.GetTopic("events")
+			topic.mu.RLock()
+			dropped := topic.DroppedCount
+			topic.mu.RUnlock()
+			if overflow == OverflowDrop && dropped == 0 {
+				t.Fatal("slow subscriber dropped nothing")
+			}
+			if overflow == OverflowSpill && dropped != 0 {
+				t.Fatalf("spilling subscriber dropped %d messages", dropped)
+			}
+		})
+	}
+}
+
+func TestDetachedSubscriberDoesNotStallTopic(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	live, err := b.Subscribe("events", "live", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	away, err := b.Subscribe("events", "away", SubscribeOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Detach(away.ID)
+
+	done := make(chan int)
+	go func() { done <- receive(t, b, live, 100) }()
+	publishAll(t, b, "events", 100)
+	if got := <-done; got != 100 {
+		t.Fatalf("live subscriber received %d of 100 messages", got)
+	}
+}
+
+func TestDetachedBacklogKeepsNewest(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10, MaxBacklog: 5, BacklogOverflow: OverflowDropOldest})
+	away, err := b.Subscribe("events", "away", SubscribeOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Detach(away.ID)
+	publishAll(t, b, "events", 50)
+
+	topic, _ := b.GetTopic("events")
+	deadline := time.Now().Add(2 * time.Second)
+	for topic.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	sub, err := b.Subscribe("events", "away", SubscribeOptions{Durable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 45; i < 50; i++ {
+		select {
+		case msg := <-sub.MessageChannel:
+			if string(msg.Payload) != fmt.Sprint(i) {
+				t.Fatalf("got message %s, want %d", msg.Payload, i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d not redelivered after resume", i)
+		}
+	}
+	select {
+	case msg := <-sub.MessageChannel:
+		t.Fatalf("backlog kept extra message %s", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWildcardSkipsDeadLetterTopics(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize:  10,
+		MaxDeliveries: 1,
+		Topics:        map[string]TopicConfig{"orders.eu": {DeadLetterTopic: "orders.failed"}},
+	})
+	sub, err := b.Subscribe("orders.>", "all", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAll(t, b, "orders.us", 1)
+	publishAll(t, b, "orders.eu", 1)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-sub.MessageChannel:
+			if err := b.Nack(msg.Topic, sub.ID, msg.ID, NackOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+	for _, name := range []string{"orders.us.dlq", "orders.failed"} {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if topic, err := b.GetTopic(name); err == nil && topic.Len() == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("message not dead-lettered to %s", name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	select {
+	case msg := <-sub.MessageChannel:
+		t.Fatalf("dead letter %s delivered to the wildcard subscription", msg.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"fmt"
+	"queuego/pkg/types"
+	"time"
+)
+
+// maxTransactionSize bounds the messages a single transaction may stage.
+const maxTransactionSize = 10000
+
+// Transaction stages messages for one or more topics. nothing is published until
+// the broker commits it, and then either every staged message is published or none is.
+type Transaction struct {
+	msgs []*types.Message
+}
+
+// NewTransaction returns an empty transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// Stage adds msg to the messages published to topicName on commit.
+func (tx *Transaction) Stage(topicName string, msg *types.Message) error {
+	if IsWildcard(topicName) {
+		return errWildcardTopic
+	}
+	if len(tx.msgs) >= maxTransactionSize {
+		return fmt.Errorf("transaction cannot stage more than %d messages", maxTransactionSize)
+	}
+	msg.Topic = topicName
+	tx.msgs = append(tx.msgs, msg)
+	return nil
+}
+
+// Len returns the number of staged messages.
+func (tx *Transaction) Len() int {
+	return len(tx.msgs)
+}
+
+// Commit publishes the messages staged in tx together. all of them are checked first:
+// inboxes must exist, payloads must fit the topics' max message size, queues must
+// have room and producer-assigned IDs must not be duplicates, and a failed check
+// rejects the whole transaction, removing the topics the commit created for it.
+// other publishes wait meanwhile, so they cannot take the room the commit relies on.
+func (b *Broker) Commit(tx *Transaction) error {
+	b.txMu.Lock()
+	defer b.txMu.Unlock()
+
+	topics := make(map[string]*Topic)
+	var order, created []*Topic
+	reject := func(err error) error {
+		for _, topic := range created {
+			b.removeUnused(topic)
+		}
+		return err
+	}
+	staged := make(map[*Topic][]*types.Message)
+	for _, msg := range tx.msgs {
+		topic, ok := topics[msg.Topic]
+		if !ok {
+			_, err := b.GetTopic(msg.Topic)
+			existed := err == nil
+			if topic, err = b.topicFor(msg.Topic); err != nil {
+				return reject(err)
+			}
+			if !existed {
+				created = append(created, topic)
+			}
+			topics[msg.Topic] = topic
+			order = append(order, topic)
+		}
+		if err := topic.checkSize(msg); err != nil {
+			return reject(err)
+		}
+		if msg.Retain && len(msg.Payload) == 0 {
+			continue // clears the retained value, takes no room
+		}
+		staged[topic] = append(staged[topic], msg)
+	}
+
+	now := time.Now()
+	var recorded []*types.Message
+	forget := func() {
+		for _, msg := range recorded {
+			topics[msg.Topic].dedup.forget(msg.ID)
+		}
+	}
+	for _, msg := range tx.msgs {
+		if msg.ID == "" {
+			msg.ID = newMessageID()
+			continue
+		}
+		if !topics[msg.Topic].dedup.record(msg.ID, now) {
+			forget()
+			return reject(fmt.Errorf("message %s: %w", msg.ID, ErrDuplicate))
+		}
+		recorded = append(recorded, msg)
+	}
+	for _, topic := range order {
+		if err := topic.room(staged[topic]); err != nil {
+			forget()
+			return reject(err)
+		}
+	}
+
+	for i, msg := range tx.msgs {
+		topic := topics[msg.Topic]
+		if msg.Retain && len(msg.Payload) == 0 {
+			if err := b.ClearRetained(msg.Topic); err != nil {
+				return fmt.Errorf("commit stopped after %d of %d messages: %w", i, len(tx.msgs), err)
+			}
+			continue
+		}
+		// only appending to a log topic's storage can still fail here
+		if err := topic.publish(msg, true); err != nil {
+			return fmt.Errorf("commit stopped after %d of %d messages: %w", i, len(tx.msgs), err)
+		}
+		b.published(topic, msg)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+func stage(t *testing.T, tx *Transaction, topic string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := tx.Stage(topic, &types.Message{ID: id, Payload: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCommitPublishesEveryTopic(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10, DedupWindow: time.Minute})
+	orders, err := b.Subscribe("orders", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := b.Subscribe("audit", "app", SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := NewTransaction()
+	stage(t, tx, "orders", "o1", "o2")
+	stage(t, tx, "audit", "a1")
+	if tx.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", tx.Len())
+	}
+	if err := b.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"o1", "o2"} {
+		if msg := next(t, orders); msg.ID != want {
+			t.Fatalf("orders got %s, want %s", msg.ID, want)
+		}
+	}
+	if msg := next(t, audit); msg.ID != "a1" {
+		t.Fatalf("audit got %s, want a1", msg.ID)
+	}
+}
+
+func TestCommitIsAllOrNothing(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize: 10,
+		DedupWindow:  time.Minute,
+		Topics:       map[string]TopicConfig{"small": {MaxQueueSize: 2}},
+	})
+
+	tx := NewTransaction()
+	stage(t, tx, "orders", "o1")
+	stage(t, tx, "small", "s1", "s2", "s3")
+	if err := b.Commit(tx); err == nil {
+		t.Fatal("commit beyond the queue size succeeded")
+	}
+	for _, name := range []string{"orders", "small"} {
+		if topic, err := b.GetTopic(name); err == nil && topic.Len() != 0 {
+			t.Fatalf("failed commit left %d messages in %s", topic.Len(), name)
+		}
+	}
+
+	// the rejected IDs were not remembered, so a smaller retry goes through
+	tx = NewTransaction()
+	stage(t, tx, "orders", "o1")
+	stage(t, tx, "small", "s1", "s2")
+	if err := b.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitRejectsDuplicates(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10, DedupWindow: time.Minute})
+	if err := b.Publish("orders", &types.Message{ID: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := NewTransaction()
+	stage(t, tx, "audit", "a1")
+	stage(t, tx, "orders", "o1")
+	if err := b.Commit(tx); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("commit returned %v, want ErrDuplicate", err)
+	}
+	if topic, err := b.GetTopic("audit"); err == nil && topic.Len() != 0 {
+		t.Fatal("commit with a duplicate published to another topic")
+	}
+}
+
+func TestStageRejectsWildcardsAndCommitMissingInboxes(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{MaxQueueSize: 10})
+	tx := NewTransaction()
+	if err := tx.Stage("orders.*", &types.Message{}); err == nil {
+		t.Fatal("staged a message for a wildcard")
+	}
+	stage(t, tx, inboxPrefix+"gone", "r1")
+	if err := b.Commit(tx); err == nil {
+		t.Fatal("commit to a missing inbox succeeded")
+	}
+}
+
+func TestRejectedCommitRemovesCreatedTopics(t *testing.T) {
+	b := newTestBroker(t, BrokerConfig{
+		MaxQueueSize: 10,
+		Topics:       map[string]TopicConfig{"small": {MaxQueueSize: 1}},
+	})
+	if _, err := b.Subscribe("orders", "app", SubscribeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("audit.>", "app", SubscribeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := NewTransaction()
+	stage(t, tx, "orders", "o1")
+	stage(t, tx, "audit.orders", "a1")
+	stage(t, tx, "small", "s1", "s2")
+	if err := b.Commit(tx); err == nil {
+		t.Fatal("commit beyond the queue size succeeded")
+	}
+	if _, err := b.GetTopic("orders"); err != nil {
+		t.Fatal("rejected commit removed a topic it did not create")
+	}
+	// a wildcard subscription alone does not keep a topic
+	for _, name := range []string{"audit.orders", "small"} {
+		if _, err := b.GetTopic(name); err == nil {
+			t.Fatalf("rejected commit left topic %s behind", name)
+		}
+	}
+
+	tx = NewTransaction()
+	stage(t, tx, "audit.orders", "a1")
+	if err := b.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+	topic, err := b.GetTopic("audit.orders")
+	if err != nil || len(topic.Subscriptions) != 1 {
+		t.Fatalf("recreated topic %v, %v: wildcard subscription not attached again", topic, err)
+	}
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// topic name wildcards. names are dot separated levels, e.g. "orders.eu.created".
+const (
+	wildcardOne  = "*" // matches exactly one level
+	wildcardRest = ">" // matches one or more trailing levels
+	wildcardHash = "#" // alias of ">"
+)
+
+var errWildcardTopic = errors.New("topic name cannot contain wildcards")
+
+// IsWildcard reports whether name is a subscription pattern rather than a topic name.
+func IsWildcard(name string) bool {
+	for _, level := range strings.Split(name, ".") {
+		if level == wildcardOne || level == wildcardRest || level == wildcardHash {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePattern checks that a pattern has no empty levels and only ends with a multi-level wildcard.
+func validatePattern(pattern string) error {
+	levels := strings.Split(pattern, ".")
+	for i, level := range levels {
+		if level == "" {
+			return errors.New("pattern " + pattern + " has an empty level")
+		}
+		if (level == wildcardRest || level == wildcardHash) && i != len(levels)-1 {
+			return errors.New("pattern " + pattern + ": " + level + " must be the last level")
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether topic matches pattern.
+func MatchTopic(pattern, topic string) bool {
+	pl := strings.Split(pattern, ".")
+	tl := strings.Split(topic, ".")
+	for i, level := range pl {
+		if level == wildcardRest || level == wildcardHash {
+			return len(tl) > i
+		}
+		if i >= len(tl) || (level != wildcardOne && level != tl[i]) {
+			return false
+		}
+	}
+	return len(pl) == len(tl)
+}
+
+// wildcardSubscription follows every topic whose name matches a pattern, including
+// topics created after it subscribed. each matched topic gets its own subscription,
+// all of them feeding the channel of head and sharing its prefetch window.
+type wildcardSubscription struct {
+	head   *Subscription
+	opts   SubscribeOptions
+	topics map[string]*Subscription // topic name -> subscription in that topic
+}
+
+// attach subscribes to topic on behalf of the pattern. callers hold b.mu.
+func (w *wildcardSubscription) attach(topic *Topic, ackTimeout time.Duration) error {
+	sub := NewSubscription(w.head.ID, topic.Name, w.head.ClientID, 0, w.head.Filter)
+	sub.FilterExpr = w.head.FilterExpr
+	sub.MessageChannel = w.head.MessageChannel
+	sub.sharedChannel = true
+	sub.Group = w.opts.Group
+	sub.AckTimeout = ackTimeout
+	// the pattern's prefetch window covers all its topics together
+	sub.Prefetch = w.opts.Prefetch
+	sub.window = w.head.window
+	sub.Durable = w.opts.Durable
+	sub.ConfirmWrites = w.opts.ConfirmWrites
+	sub.Overflow = w.opts.Overflow
+	if sub.Overflow == "" {
+		sub.Overflow = topic.Config.Overflow
+	}
+	if topic.log != nil {
+		// queue topics matched by the same pattern have no offsets
+		sub.StartOffset = w.opts.Offset
+	}
+	if err := topic.AddSubscription(sub); err != nil {
+		return err
+	}
+	w.topics[topic.Name] = sub
+	return nil
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EncodeBatch packs commands into the payload of a BATCH frame:
+// a uint32 count followed by each encoded command with a uint32 length prefix.
+func EncodeBatch(cmds []*Command) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(cmds))); err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		data, err := Encode(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("batch command %d: %w", i, err)
+		}
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(data))); err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBatch unpacks the commands of a BATCH payload.
+func DecodeBatch(data []byte) ([]*Command, error) {
+	buf := bytes.NewReader(data)
+	var count uint32
+	if err := binary.Read(buf, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("reading batch count: %w", err)
+	}
+	// every command takes at least its length prefix and 11 bytes
+	if int64(count)*15 > int64(buf.Len()) {
+		return nil, errors.New("batch count exceeds its data")
+	}
+	cmds := make([]*Command, 0, count)
+	for i := 0; i < int(count); i++ {
+		var n uint32
+		if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("reading batch command %d length: %w", i, err)
+		}
+		if int64(n) > int64(buf.Len()) {
+			return nil, fmt.Errorf("reading batch command %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(buf, b); err != nil {
+			return nil, fmt.Errorf("reading batch command %d: %w", i, err)
+		}
+		cmd, err := Decode(b)
+		if err != nil {
+			return nil, fmt.Errorf("batch command %d: %w", i, err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressionThreshold is the payload size from which frames are compressed
+// when compression is enabled without a threshold.
+const DefaultCompressionThreshold = 1024
+
+// maxDecompressedSize bounds the payload a compressed frame may expand to.
+const maxDecompressedSize = 64 << 20
+
+// Codec compresses frame payloads. a codec is negotiated at CONNECT by its name,
+// and each compressed frame carries its ID so the receiver knows how to expand it.
+type Codec interface {
+	Name() string
+	ID() byte // 1-127, unique among registered codecs
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecs     = make(map[string]Codec)
+	codecsByID = make(map[byte]Codec)
+	codecsMu   sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(&streamCodec{
+		name: "gzip",
+		id:   1,
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+	RegisterCodec(&streamCodec{
+		name: "deflate",
+		id:   2,
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+}
+
+// RegisterCodec makes a codec available for negotiation and decoding.
+func RegisterCodec(c Codec) error {
+	if c.ID() == 0 || c.ID() >= compressedFlag {
+		return fmt.Errorf("codec %s: id must be between 1 and %d", c.Name(), compressedFlag-1)
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[c.Name()]; ok {
+		return fmt.Errorf("codec %s is already registered", c.Name())
+	}
+	if other, ok := codecsByID[c.ID()]; ok {
+		return fmt.Errorf("codec %s: id %d is used by %s", c.Name(), c.ID(), other.Name())
+	}
+	codecs[c.Name()] = c
+	codecsByID[c.ID()] = c
+	return nil
+}
+
+// LookupCodec returns the registered codec called name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+func codecByID(id byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecsByID[id]
+	return c, ok
+}
+
+// Negotiate picks the first codec of offered, a comma-separated list in order of
+// preference, that is registered and listed in accepted. it returns nil when none is.
+func Negotiate(offered string, accepted []string) Codec {
+	for _, name := range strings.Split(offered, ",") {
+		name = strings.TrimSpace(name)
+		for _, a := range accepted {
+			if a != name {
+				continue
+			}
+			if c, ok := LookupCodec(name); ok {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// streamCodec adapts the compressors of the standard library.
+type streamCodec struct {
+	name   string
+	id     byte
+	writer func(io.Writer) (io.WriteCloser, error)
+	reader func(io.Reader) (io.ReadCloser, error)
+}
+
+func (c *streamCodec) Name() string { return c.name }
+func (c *streamCodec) ID() byte     { return c.id }
+
+func (c *streamCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *streamCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := c.reader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, errors.New("decompressed payload too large")
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func codec(t *testing.T, name string) Codec {
+	t.Helper()
+	c, ok := LookupCodec(name)
+	if !ok {
+		t.Fatalf("codec %s is not registered", name)
+	}
+	return c
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	for _, name := range []string{"gzip", "deflate"} {
+		t.Run(name, func(t *testing.T) {
+			c := codec(t, name)
+			cmd := &Command{
+				Type:    DELIVER,
+				Topic:   "orders",
+				Headers: map[string]string{HeaderOffset: "7"},
+				Payload: bytes.Repeat([]byte("compressible "), 500),
+			}
+			plain, err := Encode(cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := EncodeCompressed(cmd, c, DefaultCompressionThreshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[0]&compressedFlag == 0 || data[1] != c.ID() {
+				t.Fatalf("frame starts %x %x, want the compressed flag and codec %d", data[0], data[1], c.ID())
+			}
+			if len(data) >= len(plain) {
+				t.Fatalf("compressed frame has %d bytes, plain %d", len(data), len(plain))
+			}
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, cmd) {
+				t.Fatalf("decoded %+v, want %+v", got, cmd)
+			}
+		})
+	}
+}
+
+func TestEncodeCompressedSkips(t *testing.T) {
+	c := codec(t, "gzip")
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		codec     Codec
+		threshold int
+	}{
+		{"no codec", bytes.Repeat([]byte("a"), 4096), nil, 0},
+		{"below threshold", bytes.Repeat([]byte("a"), 100), c, DefaultCompressionThreshold},
+		{"empty payload", nil, c, 0},
+		{"incompressible", random, c, 0},
+	}
+	for _, tt := range tests {
+		cmd := &Command{Type: PUBLISH, Topic: "orders", Payload: tt.payload}
+		data, err := EncodeCompressed(cmd, tt.codec, tt.threshold)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if data[0]&compressedFlag != 0 {
+			t.Errorf("%s: payload was compressed", tt.name)
+		}
+		if got, err := Decode(data); err != nil || !bytes.Equal(got.Payload, cmd.Payload) {
+			t.Errorf("%s: decoded %v, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestDecodeUnknownCodec(t *testing.T) {
+	cmd := &Command{Type: PUBLISH, Topic: "orders", Payload: bytes.Repeat([]byte("a"), 4096)}
+	data, err := EncodeCompressed(cmd, codec(t, "gzip"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[1] = 99
+	if _, err := Decode(data); err == nil || !strings.Contains(err.Error(), "unknown compression codec") {
+		t.Fatalf("Decode returned %v, want an unknown codec error", err)
+	}
+
+	// a codec ID that does not match the payload fails to decompress
+	data[1] = codec(t, "deflate").ID()
+	if _, err := Decode(data); err == nil {
+		t.Fatal("decoded a gzip payload as deflate")
+	}
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	c := codec(t, "gzip")
+	cmd := &Command{Type: PUBLISH, Topic: "orders", Payload: make([]byte, maxDecompressedSize+1)}
+
+	// the sender leaves such payloads uncompressed
+	data, err := EncodeCompressed(cmd, c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]&compressedFlag != 0 {
+		t.Fatal("compressed a payload the receiver cannot expand")
+	}
+
+	// and the receiver refuses one that would expand past the limit
+	compressed, err := c.Compress(cmd.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = Encode(&Command{Type: PUBLISH, Topic: "orders", Payload: compressed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte{data[0] | compressedFlag, c.ID()}, data[1:]...)
+	if _, err := Decode(data); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("Decode returned %v, want a size error", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		offered  string
+		accepted []string
+		want     string
+	}{
+		{"gzip", []string{"gzip", "deflate"}, "gzip"},
+		{"deflate, gzip", []string{"gzip", "deflate"}, "deflate"},
+		{"zstd,gzip", []string{"gzip", "zstd"}, "gzip"}, // zstd is not registered
+		{"gzip", []string{"deflate"}, ""},
+		{"", []string{"gzip"}, ""},
+		{"gzip", nil, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if c := Negotiate(tt.offered, tt.accepted); c != nil {
+			got = c.Name()
+		}
+		if got != tt.want {
+			t.Errorf("Negotiate(%q, %v) = %q, want %q", tt.offered, tt.accepted, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterCodecRejects(t *testing.T) {
+	for _, c := range []Codec{
+		&streamCodec{name: "zero", id: 0},
+		&streamCodec{name: "flagged", id: compressedFlag},
+		&streamCodec{name: "gzip", id: 42},
+		&streamCodec{name: "other", id: 1},
+	} {
+		if err := RegisterCodec(c); err == nil {
+			t.Errorf("registered codec %s with id %d", c.Name(), c.ID())
+		}
+	}
+}
@@ -9,8 +9,8 @@ import (
 )
 
 func Decode(data []byte) (*Command, error) {
-	// minimum bytes: 1 (type) + 2 (topic len) + 4 (payload len) = 7
-	if len(data) < 7 {
+	// minimum bytes: 1 (type) + 2 (topic len) + 2 (id len) + 2 (header count) + 4 (payload len) = 11
+	if len(data) < 11 {
 		return nil, errors.New("data too short to decode")
 	}
 
@@ -21,41 +21,98 @@ func Decode(data []byte) (*Command, error) {
 	if err != nil {
 		return nil, err
 	}
+	var codec Codec
+	if cmdTypeByte&compressedFlag != 0 {
+		id, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if codec, ok = codecByID(id); !ok {
+			return nil, fmt.Errorf("unknown compression codec %d", id)
+		}
+		cmdTypeByte &^= compressedFlag
+	}
 	cmdType := byteToCommandType(cmdTypeByte)
 	if cmdType == "" {
 		return nil, errors.New("invalid command type")
 	}
 
 	// 2. Topic
-	var topicLen uint16
-	if err := binary.Read(buf, binary.BigEndian, &topicLen); err != nil {
-		return nil, fmt.Errorf("reading topic length: %w", err)
-	}
-	topicBytes := make([]byte, topicLen)
-	if _, err := io.ReadFull(buf, topicBytes); err != nil {
+	topic, err := readString(buf)
+	if err != nil {
 		return nil, fmt.Errorf("reading topic: %w", err)
 	}
-	topic := string(topicBytes)
 
-	// 3. Payload
+	// 3. Message ID
+	messageID, err := readString(buf)
+	if err != nil {
+		return nil, fmt.Errorf("reading message id: %w", err)
+	}
+
+	// 4. Headers
+	var headerCount uint16
+	if err := binary.Read(buf, binary.BigEndian, &headerCount); err != nil {
+		return nil, fmt.Errorf("reading header count: %w", err)
+	}
+	var headers map[string]string
+	if headerCount > 0 {
+		headers = make(map[string]string, headerCount)
+		for i := 0; i < int(headerCount); i++ {
+			k, err := readString(buf)
+			if err != nil {
+				return nil, fmt.Errorf("reading header key: %w", err)
+			}
+			v, err := readString(buf)
+			if err != nil {
+				return nil, fmt.Errorf("reading header value: %w", err)
+			}
+			headers[k] = v
+		}
+	}
+
+	// 5. Payload
 	var payloadLen uint32
 	if err := binary.Read(buf, binary.BigEndian, &payloadLen); err != nil {
 		return nil, fmt.Errorf("reading payload length: %w", err)
 	}
+	if int64(payloadLen) > int64(buf.Len()) {
+		return nil, fmt.Errorf("reading payload: %w", io.ErrUnexpectedEOF)
+	}
 	payload := make([]byte, payloadLen)
 	if payloadLen > 0 {
 		if _, err := io.ReadFull(buf, payload); err != nil {
 			return nil, fmt.Errorf("reading payload: %w", err)
 		}
 	}
+	if codec != nil {
+		if payload, err = codec.Decompress(payload); err != nil {
+			return nil, fmt.Errorf("decompressing payload with %s: %w", codec.Name(), err)
+		}
+	}
 
 	return &Command{
-		Type:    cmdType,
-		Topic:   topic,
-		Payload: payload,
+		Type:      cmdType,
+		Topic:     topic,
+		MessageID: messageID,
+		Headers:   headers,
+		Payload:   payload,
 	}, nil
 }
 
+// readString reads a uint16 length-prefixed string
+func readString(buf *bytes.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(buf, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func byteToCommandType(b byte) CommandType {
 	switch b {
 	case 0x01:
@@ -72,6 +129,26 @@ func byteToCommandType(b byte) CommandType {
 		return PING
 	case 0x07:
 		return PONG
+	case 0x08:
+		return DELIVER
+	case 0x09:
+		return REDRIVE
+	case 0x0A:
+		return NACK
+	case 0x0B:
+		return CREDIT
+	case 0x0C:
+		return ERR
+	case 0x0D:
+		return INBOX
+	case 0x0E:
+		return BEGIN
+	case 0x0F:
+		return COMMIT
+	case 0x10:
+		return ABORT
+	case 0x11:
+		return BATCH
 	default:
 		return ""
 	}
@@ -6,7 +6,18 @@ import (
 	"errors"
 )
 
+// compressedFlag is set in the command type byte of a frame whose payload is
+// compressed. the ID of the codec used follows the type byte.
+const compressedFlag = 0x80
+
 func Encode(cmd *Command) ([]byte, error) {
+	return EncodeCompressed(cmd, nil, 0)
+}
+
+// EncodeCompressed encodes cmd like Encode, compressing its payload with codec when
+// it has at least threshold bytes and comes out smaller. a nil codec never compresses,
+// nor are payloads too large for the receiver to expand again.
+func EncodeCompressed(cmd *Command, codec Codec, threshold int) ([]byte, error) {
 	if cmd.Type == "" {
 		return nil, errors.New("command type is required")
 	}
@@ -14,30 +25,75 @@ func Encode(cmd *Command) ([]byte, error) {
 		cmd.Payload = []byte{}
 	}
 
+	payload := cmd.Payload
+	compressed := false
+	if codec != nil && len(payload) > 0 && len(payload) >= threshold && len(payload) <= maxDecompressedSize {
+		data, err := codec.Compress(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < len(payload) {
+			payload, compressed = data, true
+		}
+	}
+
 	var buf bytes.Buffer
 
-	// 1. Command type (1 byte)
-	buf.WriteByte(commandTypeToByte(cmd.Type))
+	// 1. Command type (1 byte), followed by the codec ID if the payload is compressed
+	if compressed {
+		buf.WriteByte(commandTypeToByte(cmd.Type) | compressedFlag)
+		buf.WriteByte(codec.ID())
+	} else {
+		buf.WriteByte(commandTypeToByte(cmd.Type))
+	}
 
 	// 2. Topic  (uint16 length + bytes)
-	topicBytes := []byte(cmd.Topic)
-	if len(topicBytes) > 65535 {
+	if err := writeString(&buf, cmd.Topic); err != nil {
 		return nil, errors.New("topic too long")
 	}
-	if err := binary.Write(&buf, binary.BigEndian, uint16(len(topicBytes))); err != nil {
+
+	// 3. Message ID (uint16 length + bytes)
+	if err := writeString(&buf, cmd.MessageID); err != nil {
+		return nil, errors.New("message id too long")
+	}
+
+	// 4. Headers (uint16 count + length-prefixed key/value pairs)
+	if len(cmd.Headers) > 65535 {
+		return nil, errors.New("too many headers")
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint16(len(cmd.Headers))); err != nil {
 		return nil, err
 	}
-	buf.Write(topicBytes)
+	for k, v := range cmd.Headers {
+		if err := writeString(&buf, k); err != nil {
+			return nil, errors.New("header key too long")
+		}
+		if err := writeString(&buf, v); err != nil {
+			return nil, errors.New("header value too long")
+		}
+	}
 
-	// 3. Payload (uint32 length + bytes)
-	if err := binary.Write(&buf, binary.BigEndian, uint32(len(cmd.Payload))); err != nil {
+	// 5. Payload (uint32 length + bytes)
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(payload))); err != nil {
 		return nil, err
 	}
-	buf.Write(cmd.Payload)
+	buf.Write(payload)
 
 	return buf.Bytes(), nil
 }
 
+// writeString writes a uint16 length-prefixed string
+func writeString(buf *bytes.Buffer, s string) error {
+	if len(s) > 65535 {
+		return errors.New("string too long")
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	buf.WriteString(s)
+	return nil
+}
+
 // commandTypeToByte maps CommandType to a single byte
 func commandTypeToByte(t CommandType) byte {
 	switch t {
@@ -55,6 +111,26 @@ func commandTypeToByte(t CommandType) byte {
 		return 0x06
 	case PONG:
 		return 0x07
+	case DELIVER:
+		return 0x08
+	case REDRIVE:
+		return 0x09
+	case NACK:
+		return 0x0A
+	case CREDIT:
+		return 0x0B
+	case ERR:
+		return 0x0C
+	case INBOX:
+		return 0x0D
+	case BEGIN:
+		return 0x0E
+	case COMMIT:
+		return 0x0F
+	case ABORT:
+		return 0x10
+	case BATCH:
+		return 0x11
 	default:
 		return 0x00
 	}
@@ -10,8 +10,60 @@ const (
 	ACK         CommandType = "ACK"
 	PING        CommandType = "PING"
 	PONG        CommandType = "PONG"
+	DELIVER     CommandType = "DELIVER" // server push of a subscribed message
+	REDRIVE     CommandType = "REDRIVE" // move dead-lettered messages back to their topic
+	NACK        CommandType = "NACK"    // reject a delivered message
+	CREDIT      CommandType = "CREDIT"  // grant a subscription more messages
+	ERR         CommandType = "ERR"     // unsolicited error report from the broker
+	INBOX       CommandType = "INBOX"   // open the connection's temporary reply topic
+	BEGIN       CommandType = "BEGIN"   // start staging the connection's publishes in a transaction
+	COMMIT      CommandType = "COMMIT"  // publish the staged messages together
+	ABORT       CommandType = "ABORT"   // discard the staged messages
+	BATCH       CommandType = "BATCH"   // publish many messages in one frame, see EncodeBatch
 )
 
+// well-known command headers
+const (
+	HeaderMax   = "max"   // REDRIVE: maximum number of messages to move
+	HeaderCount = "count" // ACK/ERR: number of messages affected
+
+	HeaderRequeue = "requeue" // NACK: "false" dead-letters the message instead of redelivering it
+	HeaderDelay   = "delay"   // NACK/PUBLISH: duration to wait before (re)delivery, e.g. "5s"
+	HeaderReason  = "reason"  // NACK: why the message was rejected
+
+	HeaderGroup    = "group"    // SUBSCRIBE: consumer group to join
+	HeaderPrefetch = "prefetch" // SUBSCRIBE: max unacknowledged messages, 0 = unlimited
+	HeaderCredit   = "credit"   // CREDIT: number of extra messages granted
+	HeaderFilter   = "filter"   // SUBSCRIBE: filter expression, e.g. "region = 'eu' AND priority > 5"
+	HeaderOverflow = "overflow" // SUBSCRIBE: "drop" or "spill" when the subscription's outbox is full
+
+	HeaderPriority  = "priority"   // PUBLISH: message priority, higher is delivered first
+	HeaderDeliverAt = "deliver-at" // PUBLISH: RFC 3339 time or unix milliseconds the message becomes visible
+	HeaderTTL       = "ttl"        // PUBLISH: message lifetime once visible, e.g. "10m"
+	HeaderKey       = "key"        // PUBLISH: ordering key, messages with the same key share a partition
+	HeaderRetain    = "retain"     // PUBLISH: "true" keeps the message as the topic's last value, an empty payload clears it
+
+	HeaderChunkIndex = "chunk-index" // PUBLISH/DELIVER: position of this chunk in a message sent in pieces, from 0
+	HeaderChunkCount = "chunk-count" // PUBLISH/DELIVER: number of chunks the message was split into
+
+	HeaderReplyTo       = "reply-to"       // PUBLISH: topic the receiver should send its reply to
+	HeaderCorrelationID = "correlation-id" // PUBLISH: ties a reply to its request
+
+	HeaderDuplicate = "duplicate" // ACK: "true" when a PUBLISH repeated a message ID within the dedup window
+	HeaderResults   = "results"   // ACK: number of per-message ACKs packed in the payload of a BATCH answer
+
+	HeaderSubscription = "subscription" // DELIVER/ACK/NACK: wildcard pattern the message was delivered for
+
+	HeaderOffset = "offset" // SUBSCRIBE: where to start reading a log topic; DELIVER: the message's log offset
+
+	HeaderClientID = "client-id" // CONNECT: stable client identity, makes the connection's subscriptions durable
+
+	HeaderCompression = "compression" // CONNECT: codecs the client accepts, by preference, e.g. "gzip,deflate"; ACK: the codec chosen
+)
+
+// DefaultChunkSize is the payload bytes per chunk of a message too large for one frame.
+const DefaultChunkSize = 1 << 20
+
 // status represents response status codes
 
 type StatusCode string
@@ -25,10 +77,11 @@ const (
 
 // command represents a request sent from client to broker
 type Command struct {
-	Type      CommandType `json:"type"`
-	Topic     string      `json:"topic,omitempty"`
-	MessageID string      `json:"message_id,omitempty"`
-	Payload   []byte      `json:"payload,omitempty"`
+	Type      CommandType       `json:"type"`
+	Topic     string            `json:"topic,omitempty"`
+	MessageID string            `json:"message_id,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   []byte            `json:"payload,omitempty"`
 	Status    StatusCode
 }
 
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	cmd := &Command{
+		Type:      PUBLISH,
+		Topic:     "orders",
+		MessageID: "m1",
+		Headers:   map[string]string{HeaderKey: "customer-1", HeaderPriority: "5"},
+		Payload:   []byte("hello"),
+	}
+	data, err := Encode(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cmd) {
+		t.Fatalf("decoded %+v, want %+v", got, cmd)
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	batches := [][]*Command{
+		{},
+		{{Type: PUBLISH, Topic: "orders", Payload: []byte{}}},
+		{
+			{Type: PUBLISH, Topic: "orders", MessageID: "m1", Payload: []byte("a")},
+			{Type: PUBLISH, Topic: "audit", MessageID: "m2", Headers: map[string]string{HeaderTTL: "1m"}, Payload: []byte("bb")},
+			{Type: PUBLISH, Topic: "orders", MessageID: "m3", Payload: make([]byte, 70000)},
+		},
+	}
+	for _, cmds := range batches {
+		data, err := EncodeBatch(cmds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeBatch(data)
+		if err != nil {
+			t.Fatalf("batch of %d: %v", len(cmds), err)
+		}
+		if len(got) != len(cmds) {
+			t.Fatalf("decoded %d commands, want %d", len(got), len(cmds))
+		}
+		for i := range cmds {
+			if !reflect.DeepEqual(got[i], cmds[i]) {
+				t.Fatalf("command %d decoded as %+v, want %+v", i, got[i], cmds[i])
+			}
+		}
+	}
+
+	if _, err := EncodeBatch([]*Command{{Topic: "orders"}}); err == nil {
+		t.Fatal("encoded a batch command without a type")
+	}
+}
+
+func TestDecodeBatchRejects(t *testing.T) {
+	payload := []byte("a payload of 24 bytes...")
+	valid, err := EncodeBatch([]*Command{
+		{Type: PUBLISH, Topic: "orders", Payload: payload},
+		{Type: PUBLISH, Topic: "orders", Payload: payload},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// withCount returns valid with its command count replaced by n
+	withCount := func(n uint32) []byte {
+		data := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint32(data, n)
+		return data
+	}
+	// withType returns valid with the type byte of its first command replaced by b
+	withType := func(b byte) []byte {
+		data := append([]byte(nil), valid...)
+		data[8] = b
+		return data
+	}
+	// withLength returns valid with the length prefix of its first command replaced by n
+	withLength := func(n uint32) []byte {
+		data := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint32(data[4:], n)
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short count", []byte{0, 0}},
+		{"truncated command", valid[:len(valid)-3]},
+		{"missing command", withCount(3)},
+		{"truncated length prefix", append(withCount(3), 0, 0)},
+		{"count larger than data", withCount(1000)},
+		{"count overflowing", withCount(0xFFFFFFFF)},
+		{"length past the end", withLength(1 << 20)},
+		{"length too short", withLength(5)},
+		{"unknown command type", withType(0x7F)},
+	}
+	for _, tt := range tests {
+		if cmds, err := DecodeBatch(tt.data); err == nil {
+			t.Errorf("%s: decoded %d commands without an error", tt.name, len(cmds))
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"queuego/internal/testutil"
+)
+
+// BenchmarkIdleReaders measures the CPU used by 1000 readers of empty queues,
+// like the distributors of idle topics, per millisecond of waiting.
+func BenchmarkIdleReaders(b *testing.B) {
+	for _, r := range readers {
+		b.Run(r.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for i := 0; i < 1000; i++ {
+				q := NewQueue(0)
+				go r.pop(ctx, q)
+			}
+			time.Sleep(pollInterval)
+
+			start := testutil.CPUTime(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(testutil.CPUTime(b)-start)/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
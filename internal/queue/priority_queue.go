@@ -1 +1,173 @@
 package queue
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"queuego/pkg/types"
+	"sync"
+	"time"
+)
+
+// priorityItem wraps a message with its insertion sequence so messages of the
+// same priority keep FIFO order.
+type priorityItem struct {
+	msg *types.Message
+	seq int64
+}
+
+// priorityHeap implements heap.Interface, highest priority first.
+type priorityHeap []*priorityItem
+
+func (h priorityHeap) Len() int { return len(h) }
+
+func (h priorityHeap) Less(i, j int) bool {
+	if h[i].msg.Priority != h[j].msg.Priority {
+		return h[i].msg.Priority > h[j].msg.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x any) { *h = append(*h, x.(*priorityItem)) }
+
+func (h *priorityHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// PriorityQueue is a thread-safe message queue ordered by Message.Priority
+// (higher first), FIFO within a priority level.
+type PriorityQueue struct {
+	mu       sync.Mutex
+	items    priorityHeap
+	notify   notifier
+	seq      int64 // next sequence for Push
+	frontSeq int64 // next sequence for PushFront, counts down
+	MaxSize  int
+}
+
+// NewPriorityQueue creates a new priority queue with optional max size 0
+func NewPriorityQueue(maxSize int) *PriorityQueue {
+	return &PriorityQueue{
+		items:   priorityHeap{},
+		notify:  newNotifier(),
+		MaxSize: maxSize,
+	}
+}
+
+// notify returns a channel that receives a value after messages are added.
+func (q *PriorityQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// push adds a message behind the messages of the same priority
+func (q *PriorityQueue) Push(msg *types.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.MaxSize > 0 && len(q.items) >= q.MaxSize {
+		return errors.New("queue is full")
+	}
+	heap.Push(&q.items, &priorityItem{msg: msg, seq: q.seq})
+	q.seq++
+	q.notify.signal()
+	return nil
+}
+
+// pushFront puts a message back ahead of the messages of the same priority.
+// it ignores the max size so requeued messages are never lost.
+func (q *PriorityQueue) PushFront(msg *types.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.frontSeq--
+	heap.Push(&q.items, &priorityItem{msg: msg, seq: q.frontSeq})
+	q.notify.signal()
+}
+
+// append adds a message like push but ignores the max size,
+// for messages whose room the caller already checked.
+func (q *PriorityQueue) Append(msg *types.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	heap.Push(&q.items, &priorityItem{msg: msg, seq: q.seq})
+	q.seq++
+	q.notify.signal()
+}
+
+// pop removes and returns the highest priority message,
+// waiting for one to be pushed until ctx is done.
+func (q *PriorityQueue) Pop(ctx context.Context) (*types.Message, error) {
+	return popWait(ctx, q.notify, q.TryPop)
+}
+
+// tryPop removes and returns the highest priority message without waiting.
+func (q *PriorityQueue) TryPop() (*types.Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, ErrEmpty
+	}
+	msg := heap.Pop(&q.items).(*priorityItem).msg
+	if len(q.items) > 0 {
+		q.notify.signal()
+	}
+	return msg, nil
+}
+
+// peek returns the highest priority message without removing it.
+func (q *PriorityQueue) Peek() (*types.Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, ErrEmpty
+	}
+	return q.items[0].msg, nil
+}
+
+// full reports whether the queue reached its max size.
+func (q *PriorityQueue) Full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.MaxSize > 0 && len(q.items) >= q.MaxSize
+}
+
+// len returns the current number of messages in the queue.
+func (q *PriorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// clear removes all messages from the queue.
+func (q *PriorityQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = priorityHeap{}
+}
+
+// removeExpired drops the messages past their expiry time and returns them.
+func (q *PriorityQueue) RemoveExpired(now time.Time) []*types.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var expired []*types.Message
+	kept := priorityHeap{}
+	for _, item := range q.items {
+		if item.msg.IsExpired(now) {
+			expired = append(expired, item.msg)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	heap.Init(&kept)
+	q.items = kept
+	return expired
+}
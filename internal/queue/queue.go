@@ -1,16 +1,65 @@
 package queue
 
 import (
+	"context"
 	"errors"
 	"queuego/pkg/types"
 	"sync"
 	"time"
 )
 
+// MessageQueue is the contract shared by the topic queue implementations.
+type MessageQueue interface {
+	Push(msg *types.Message) error
+	PushFront(msg *types.Message)
+	Append(msg *types.Message)
+	Pop(ctx context.Context) (*types.Message, error)
+	TryPop() (*types.Message, error)
+	Peek() (*types.Message, error)
+	Notify() <-chan struct{}
+	Full() bool
+	Len() int
+	Clear()
+	RemoveExpired(now time.Time) []*types.Message
+}
+
+// ErrEmpty is returned by the non-blocking reads of an empty queue.
+var ErrEmpty = errors.New("queue is empty")
+
+// notifier wakes a waiting reader when messages are added.
+type notifier chan struct{}
+
+func newNotifier() notifier {
+	return make(notifier, 1)
+}
+
+// signal records that messages are available without blocking.
+func (n notifier) signal() {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
+// popWait blocks on tryPop until it returns a message or ctx is done.
+func popWait(ctx context.Context, n notifier, tryPop func() (*types.Message, error)) (*types.Message, error) {
+	for {
+		if msg, err := tryPop(); err == nil {
+			return msg, nil
+		}
+		select {
+		case <-n:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // queue represents a thread-safe message queue.
 type Queue struct {
 	mu       sync.Mutex
 	messages []*types.Message
+	notify   notifier
 	MaxSize  int
 }
 
@@ -18,10 +67,16 @@ type Queue struct {
 func NewQueue(maxSize int) *Queue {
 	return &Queue{
 		messages: []*types.Message{},
+		notify:   newNotifier(),
 		MaxSize:  maxSize,
 	}
 }
 
+// notify returns a channel that receives a value after messages are added.
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
 // push adds a message to the end of the queue
 func (q *Queue) Push(msg *types.Message) error {
 	q.mu.Lock()
@@ -31,20 +86,56 @@ func (q *Queue) Push(msg *types.Message) error {
 		return errors.New("queue is full")
 	}
 	q.messages = append(q.messages, msg)
+	q.notify.signal()
 	return nil
 }
 
-// pop removes and returns the message from the front of the queue.
-func (q *Queue) Pop() (*types.Message, error) {
+// pushFront puts a message back at the head of the queue, e.g. after a failed delivery.
+// it ignores the max size so requeued messages are never lost.
+func (q *Queue) PushFront(msg *types.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append([]*types.Message{msg}, q.messages...)
+	q.notify.signal()
+}
+
+// append adds a message at the back of the queue ignoring the max size,
+// for messages whose room the caller already checked.
+func (q *Queue) Append(msg *types.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, msg)
+	q.notify.signal()
+}
+
+// full reports whether the queue reached its max size.
+func (q *Queue) Full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.MaxSize > 0 && len(q.messages) >= q.MaxSize
+}
+
+// pop removes and returns the message from the front of the queue,
+// waiting for one to be pushed until ctx is done.
+func (q *Queue) Pop(ctx context.Context) (*types.Message, error) {
+	return popWait(ctx, q.notify, q.TryPop)
+}
+
+// tryPop removes and returns the message from the front of the queue without waiting.
+func (q *Queue) TryPop() (*types.Message, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
 	if len(q.messages) == 0 {
-		return nil, errors.New("queue is empty")
+		return nil, ErrEmpty
 	}
 
 	msg := q.messages[0]
 	q.messages = q.messages[1:]
+	if len(q.messages) > 0 {
+		// pass the wake-up on to the next reader
+		q.notify.signal()
+	}
 	return msg, nil
 }
 
@@ -54,7 +145,7 @@ func (q *Queue) Peek() (*types.Message, error) {
 	defer q.mu.Unlock()
 
 	if len(q.messages) == 0 {
-		return nil, errors.New("queue is empty")
+		return nil, ErrEmpty
 	}
 
 	return q.messages[0], nil
@@ -74,15 +165,20 @@ func (q *Queue) Clear() {
 	q.messages = []*types.Message{}
 }
 
-func (q *Queue) RemoveExpired(ttl time.Duration) {
+// removeExpired drops the messages past their expiry time and returns them.
+func (q *Queue) RemoveExpired(now time.Time) []*types.Message {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
+	var expired []*types.Message
 	newQueue := []*types.Message{}
 	for _, msg := range q.messages {
-		if msg.Timestamp.Add(ttl).After(time.Now()) {
-			newQueue = append(newQueue, msg)
+		if msg.IsExpired(now) {
+			expired = append(expired, msg)
+			continue
 		}
+		newQueue = append(newQueue, msg)
 	}
 	q.messages = newQueue
+	return expired
 }
@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"queuego/pkg/types"
+)
+
+// op pushes a message with the given ID and priority, to the front if front is set.
+type op struct {
+	id       string
+	priority int
+	front    bool
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []op
+		want []string
+	}{
+		{
+			name: "higher priority first",
+			ops:  []op{{id: "low", priority: 1}, {id: "high", priority: 9}, {id: "mid", priority: 5}},
+			want: []string{"high", "mid", "low"},
+		},
+		{
+			name: "fifo within a priority",
+			ops:  []op{{id: "a", priority: 3}, {id: "b", priority: 3}, {id: "c", priority: 3}},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "fifo within each level",
+			ops: []op{
+				{id: "a1", priority: 1}, {id: "b2", priority: 2}, {id: "c1", priority: 1},
+				{id: "d2", priority: 2}, {id: "e1", priority: 1},
+			},
+			want: []string{"b2", "d2", "a1", "c1", "e1"},
+		},
+		{
+			name: "negative priorities last",
+			ops:  []op{{id: "neg", priority: -1}, {id: "zero"}},
+			want: []string{"zero", "neg"},
+		},
+		{
+			name: "push front goes ahead of its level",
+			ops:  []op{{id: "a", priority: 2}, {id: "b", priority: 2}, {id: "requeued", priority: 2, front: true}},
+			want: []string{"requeued", "a", "b"},
+		},
+		{
+			name: "push front keeps priority order",
+			ops:  []op{{id: "high", priority: 9}, {id: "low", priority: 1}, {id: "requeued", priority: 5, front: true}},
+			want: []string{"high", "requeued", "low"},
+		},
+		{
+			name: "later push front goes first",
+			ops:  []op{{id: "a"}, {id: "first", front: true}, {id: "second", front: true}},
+			want: []string{"second", "first", "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewPriorityQueue(0)
+			for _, o := range tt.ops {
+				msg := &types.Message{ID: o.id, Priority: o.priority}
+				if o.front {
+					q.PushFront(msg)
+				} else if err := q.Push(msg); err != nil {
+					t.Fatalf("push %s: %v", o.id, err)
+				}
+			}
+			if q.Len() != len(tt.want) {
+				t.Fatalf("Len() = %d, want %d", q.Len(), len(tt.want))
+			}
+			if head, err := q.Peek(); err != nil || head.ID != tt.want[0] {
+				t.Fatalf("Peek() = %v, %v, want %s", head, err, tt.want[0])
+			}
+			for i, want := range tt.want {
+				msg, err := q.TryPop()
+				if err != nil {
+					t.Fatalf("pop %d: %v", i, err)
+				}
+				if msg.ID != want {
+					t.Fatalf("pop %d = %s, want %s", i, msg.ID, want)
+				}
+			}
+			if _, err := q.TryPop(); err == nil {
+				t.Fatal("TryPop on an empty queue succeeded")
+			}
+		})
+	}
+}
+
+func TestPriorityQueueMaxSize(t *testing.T) {
+	q := NewPriorityQueue(2)
+	for _, id := range []string{"a", "b"} {
+		if err := q.Push(&types.Message{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Push(&types.Message{ID: "c", Priority: 9}); err == nil {
+		t.Fatal("Push beyond MaxSize succeeded")
+	}
+	// requeued messages are never refused
+	q.PushFront(&types.Message{ID: "requeued"})
+	if q.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", q.Len())
+	}
+	q.Clear()
+	if q.Len() != 0 {
+		t.Fatalf("Len() after Clear = %d", q.Len())
+	}
+}
+
+// pollInterval is how long the distributors slept on an empty queue before Pop(ctx).
+const pollInterval = 10 * time.Millisecond
+
+// pollPop reads q the way the distributors did before Pop(ctx): retry, sleeping while empty.
+func pollPop(ctx context.Context, q MessageQueue) (*types.Message, error) {
+	for {
+		if msg, err := q.TryPop(); err == nil {
+			return msg, nil
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// readers compares the blocking Pop with the polling loop it replaced.
+var readers = []struct {
+	name string
+	pop  func(context.Context, MessageQueue) (*types.Message, error)
+}{
+	{"wake", func(ctx context.Context, q MessageQueue) (*types.Message, error) { return q.Pop(ctx) }},
+	{"poll", pollPop},
+}
+
+// BenchmarkPopLatency measures the time from Push to a waiting reader returning the message.
+func BenchmarkPopLatency(b *testing.B) {
+	for _, r := range readers {
+		b.Run(r.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q := NewQueue(0)
+			popped := make(chan time.Time)
+			go func() {
+				for {
+					if _, err := r.pop(ctx, q); err != nil {
+						return
+					}
+					popped <- time.Now()
+				}
+			}()
+
+			msg := &types.Message{ID: "m"}
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				// let the reader find the queue empty before pushing
+				time.Sleep(100 * time.Microsecond)
+				pushed := time.Now()
+				if err := q.Push(msg); err != nil {
+					b.Fatal(err)
+				}
+				total += (<-popped).Sub(pushed)
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "latency-ns/op")
+		})
+	}
+}
+
+func TestPopWaitsForPush(t *testing.T) {
+	for _, q := range []MessageQueue{NewQueue(0), NewPriorityQueue(0)} {
+		got := make(chan *types.Message)
+		go func() {
+			msg, _ := q.Pop(context.Background())
+			got <- msg
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := q.Push(&types.Message{ID: "m"}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-got:
+			if msg.ID != "m" {
+				t.Fatalf("popped %s, want m", msg.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Pop did not return after Push")
+		}
+	}
+}
+
+func TestPopReturnsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := NewQueue(0).Pop(ctx)
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Pop returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop did not return after cancel")
+	}
+}
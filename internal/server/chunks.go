@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"queuego/internal/protocol"
+	"strconv"
+)
+
+// maxPendingChunked bounds the chunked messages a connection may reassemble at once.
+const maxPendingChunked = 16
+
+// chunkedMessage collects the chunks of a message published in pieces.
+type chunkedMessage struct {
+	first   *protocol.Command // carries the topic and headers of the whole message
+	payload []byte
+	next    int // index of the chunk expected next
+	count   int
+}
+
+// chunkAssembler reassembles the chunked messages of a connection, by message ID.
+// chunks must arrive in order; a message that starts over drops what was collected.
+type chunkAssembler struct {
+	pending     map[string]*chunkedMessage
+	buffered    int // payload bytes held by pending messages
+	maxBuffered int // bound of buffered, whatever the topics allow
+}
+
+func newChunkAssembler(maxBuffered int) *chunkAssembler {
+	return &chunkAssembler{
+		pending:     make(map[string]*chunkedMessage),
+		maxBuffered: maxBuffered,
+	}
+}
+
+// len returns the number of messages being reassembled.
+func (a *chunkAssembler) len() int {
+	return len(a.pending)
+}
+
+// drop discards the partial message id.
+func (a *chunkAssembler) drop(id string) {
+	if m, ok := a.pending[id]; ok {
+		a.buffered -= len(m.payload)
+		delete(a.pending, id)
+	}
+}
+
+// clear discards every partial message.
+func (a *chunkAssembler) clear() {
+	clear(a.pending)
+	a.buffered = 0
+}
+
+// isChunk reports whether cmd is one chunk of a larger message.
+func isChunk(cmd *protocol.Command) bool {
+	_, ok := cmd.Headers[protocol.HeaderChunkCount]
+	return ok
+}
+
+// add collects a chunk and returns the whole PUBLISH command once its last chunk
+// arrived, or nil while chunks are missing. maxSize bounds the reassembled payload,
+// 0 = unlimited, and all partial messages together stay within maxBuffered.
+func (a *chunkAssembler) add(cmd *protocol.Command, maxSize int) (*protocol.Command, error) {
+	if cmd.MessageID == "" {
+		return nil, errors.New("chunked messages need a message ID")
+	}
+	index, err := strconv.Atoi(cmd.Headers[protocol.HeaderChunkIndex])
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk index %q", cmd.Headers[protocol.HeaderChunkIndex])
+	}
+	count, err := strconv.Atoi(cmd.Headers[protocol.HeaderChunkCount])
+	if err != nil || count < 1 || index < 0 || index >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %q", index, cmd.Headers[protocol.HeaderChunkCount])
+	}
+
+	m, ok := a.pending[cmd.MessageID]
+	if index == 0 {
+		// a publish retried from the start replaces the partial message
+		if !ok && len(a.pending) >= maxPendingChunked {
+			return nil, fmt.Errorf("too many chunked messages in progress, max %d", maxPendingChunked)
+		}
+		a.drop(cmd.MessageID)
+		m = &chunkedMessage{first: cmd, count: count}
+		a.pending[cmd.MessageID] = m
+	} else if !ok || index != m.next || count != m.count || cmd.Topic != m.first.Topic {
+		a.drop(cmd.MessageID)
+		return nil, fmt.Errorf("chunk %d of message %s is out of sequence", index, cmd.MessageID)
+	}
+
+	if maxSize > 0 && len(m.payload)+len(cmd.Payload) > maxSize {
+		a.drop(cmd.MessageID)
+		return nil, fmt.Errorf("message %s exceeds the %d byte limit of topic %s", cmd.MessageID, maxSize, cmd.Topic)
+	}
+	if a.buffered+len(cmd.Payload) > a.maxBuffered {
+		a.drop(cmd.MessageID)
+		return nil, fmt.Errorf("chunked messages in progress exceed the %d byte buffer of the connection", a.maxBuffered)
+	}
+	m.payload = append(m.payload, cmd.Payload...)
+	a.buffered += len(cmd.Payload)
+	m.next++
+	if m.next < m.count {
+		return nil, nil
+	}
+
+	a.drop(cmd.MessageID)
+	headers := make(map[string]string, len(m.first.Headers))
+	for k, v := range m.first.Headers {
+		if k != protocol.HeaderChunkIndex && k != protocol.HeaderChunkCount {
+			headers[k] = v
+		}
+	}
+	return &protocol.Command{
+		Type:      protocol.PUBLISH,
+		Topic:     m.first.Topic,
+		MessageID: m.first.MessageID,
+		Headers:   headers,
+		Payload:   m.payload,
+	}, nil
+}
+
+// chunkHeaderRoom is the frame space kept for the chunk-index and chunk-count
+// headers when splitting a DELIVER.
+const chunkHeaderRoom = 64
+
+// splitDeliver returns cmd alone when its frame fits in maxFrame bytes, or else its
+// payload split over DELIVER chunks that each fit, with the topic, ID and headers
+// of the message repeated on every chunk.
+func splitDeliver(cmd *protocol.Command, maxFrame int) ([]*protocol.Command, error) {
+	head, err := protocol.Encode(&protocol.Command{
+		Type:      cmd.Type,
+		Topic:     cmd.Topic,
+		MessageID: cmd.MessageID,
+		Headers:   cmd.Headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(head)+len(cmd.Payload) <= maxFrame {
+		return []*protocol.Command{cmd}, nil
+	}
+	size := min(protocol.DefaultChunkSize, maxFrame-len(head)-chunkHeaderRoom)
+	if size <= 0 {
+		return nil, fmt.Errorf("headers of message %s leave no room for its payload in a %d byte frame", cmd.MessageID, maxFrame)
+	}
+
+	count := (len(cmd.Payload) + size - 1) / size
+	chunks := make([]*protocol.Command, count)
+	for i := range chunks {
+		headers := make(map[string]string, len(cmd.Headers)+2)
+		for k, v := range cmd.Headers {
+			headers[k] = v
+		}
+		headers[protocol.HeaderChunkIndex] = strconv.Itoa(i)
+		headers[protocol.HeaderChunkCount] = strconv.Itoa(count)
+		chunks[i] = &protocol.Command{
+			Type:      cmd.Type,
+			Topic:     cmd.Topic,
+			MessageID: cmd.MessageID,
+			Headers:   headers,
+			Payload:   cmd.Payload[i*size : min((i+1)*size, len(cmd.Payload))],
+		}
+	}
+	return chunks, nil
+}
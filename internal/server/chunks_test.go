@@ -0,0 +1,144 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"queuego/internal/protocol"
+)
+
+func chunk(id string, index, count int, payload string) *protocol.Command {
+	return &protocol.Command{
+		Type:      protocol.PUBLISH,
+		Topic:     "files",
+		MessageID: id,
+		Headers: map[string]string{
+			protocol.HeaderChunkIndex: strconv.Itoa(index),
+			protocol.HeaderChunkCount: strconv.Itoa(count),
+		},
+		Payload: []byte(payload),
+	}
+}
+
+func TestChunkAssemblerReassembles(t *testing.T) {
+	a := newChunkAssembler(100)
+	for i, part := range []string{"ab", "cd", "e"} {
+		whole, err := a.add(chunk("m", i, 3, part), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && whole != nil {
+			t.Fatalf("message complete after chunk %d", i)
+		}
+		if i == 2 {
+			if string(whole.Payload) != "abcde" {
+				t.Fatalf("payload %q, want abcde", whole.Payload)
+			}
+			if _, ok := whole.Headers[protocol.HeaderChunkCount]; ok {
+				t.Fatal("chunk headers kept on the whole message")
+			}
+		}
+	}
+	if a.len() != 0 || a.buffered != 0 {
+		t.Fatalf("%d messages, %d bytes still buffered", a.len(), a.buffered)
+	}
+}
+
+func TestChunkAssemblerBoundsBufferedBytes(t *testing.T) {
+	a := newChunkAssembler(10)
+	// topics without a max message size still share the connection's buffer
+	if _, err := a.add(chunk("m1", 0, 3, "aaaa"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.add(chunk("m2", 0, 3, "bbbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.add(chunk("m1", 1, 3, "aaaa"), 0)
+	if err == nil || !strings.Contains(err.Error(), "buffer") {
+		t.Fatalf("add returned %v, want a buffer error", err)
+	}
+	if a.len() != 1 || a.buffered != 4 {
+		t.Fatalf("%d messages, %d bytes buffered, want 1 and 4", a.len(), a.buffered)
+	}
+
+	// restarting a message releases what it had collected
+	if _, err := a.add(chunk("m2", 0, 2, "bbbbbb"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if a.buffered != 6 {
+		t.Fatalf("%d bytes buffered after restart, want 6", a.buffered)
+	}
+	a.clear()
+	if a.len() != 0 || a.buffered != 0 {
+		t.Fatalf("%d messages, %d bytes buffered after clear", a.len(), a.buffered)
+	}
+}
+
+func TestChunkAssemblerRejectsOutOfSequence(t *testing.T) {
+	a := newChunkAssembler(100)
+	if _, err := a.add(chunk("m", 0, 3, "ab"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.add(chunk("m", 2, 3, "ef"), 0); err == nil {
+		t.Fatal("chunk 2 accepted before chunk 1")
+	}
+	if a.len() != 0 || a.buffered != 0 {
+		t.Fatalf("%d messages, %d bytes kept after an out of sequence chunk", a.len(), a.buffered)
+	}
+}
+
+func TestChunkAssemblerTopicLimit(t *testing.T) {
+	a := newChunkAssembler(100)
+	if _, err := a.add(chunk("m", 0, 2, "abcd"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.add(chunk("m", 1, 2, "efgh"), 6); err == nil {
+		t.Fatal("message larger than the topic limit accepted")
+	}
+}
+
+func TestSplitDeliverFitsFrames(t *testing.T) {
+	const maxFrame = 1000
+	cmd := &protocol.Command{
+		Type:      protocol.DELIVER,
+		Topic:     "files",
+		MessageID: "m",
+		Headers:   map[string]string{"name": "big.bin"},
+		Payload:   []byte(strings.Repeat("x", 2500)),
+	}
+	frames, err := splitDeliver(cmd, maxFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) < 3 {
+		t.Fatalf("%d frames for a payload of 2.5 frames", len(frames))
+	}
+	a := newChunkAssembler(10000)
+	var whole *protocol.Command
+	for _, f := range frames {
+		data, err := protocol.Encode(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > maxFrame {
+			t.Fatalf("chunk %s encodes to %d bytes, limit %d", f.Headers[protocol.HeaderChunkIndex], len(data), maxFrame)
+		}
+		if whole, err = a.add(f, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if whole == nil || string(whole.Payload) != string(cmd.Payload) || whole.Headers["name"] != "big.bin" {
+		t.Fatalf("chunks reassemble to %v", whole)
+	}
+
+	small := &protocol.Command{Type: protocol.DELIVER, Topic: "files", MessageID: "s", Payload: []byte("x")}
+	if frames, err := splitDeliver(small, maxFrame); err != nil || len(frames) != 1 || frames[0] != small {
+		t.Fatalf("small message split into %v, %v", frames, err)
+	}
+	crowded := &protocol.Command{Type: protocol.DELIVER, Topic: "files", MessageID: "h",
+		Headers: map[string]string{"big": strings.Repeat("h", maxFrame)}, Payload: []byte("x")}
+	if _, err := splitDeliver(crowded, maxFrame); err == nil {
+		t.Fatal("message whose headers fill a frame was split")
+	}
+}
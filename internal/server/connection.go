@@ -6,30 +6,106 @@ import (
 	"io"
 	"log"
 	"net"
+	"queuego/internal/broker"
 	"queuego/internal/protocol"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// slow client policies, applied when a connection's send queue is full
+const (
+	PolicyBlock      = "block"      // wait up to SendTimeout for room, then disconnect
+	PolicyDisconnect = "disconnect" // disconnect immediately
+	PolicyDrop       = "drop"       // drop the command and report it with an ERROR frame
+)
+
+// ConnectionConfig sizes the outbound queue and picks what happens when a client
+// does not read fast enough.
+type ConnectionConfig struct {
+	SendQueueSize    int
+	SlowClientPolicy string
+	SendTimeout      time.Duration
+	MaxFrameSize     int // larger frames close the connection, 0 = DefaultMaxFrameSize
+	MaxChunkBuffer   int // bytes of chunked messages a connection may hold partially received, 0 = DefaultMaxChunkBuffer
+
+	Compression          []string // codecs clients may negotiate at CONNECT, empty disables compression
+	CompressionThreshold int      // payloads of at least this many bytes are compressed, 0 = protocol default
+}
+
+// DefaultMaxFrameSize is the largest frame a connection reads unless configured otherwise.
+// larger messages are published in chunks, see protocol.HeaderChunkIndex.
+const DefaultMaxFrameSize = 10 * 1024 * 1024
+
+// DefaultMaxChunkBuffer bounds the memory a connection uses for chunked messages
+// still being received, also on topics without a max message size.
+const DefaultMaxChunkBuffer = 64 * 1024 * 1024
+
+// outgoing is a queued command and what to call once it was written or dropped.
+type outgoing struct {
+	cmd  *protocol.Command
+	done func() // may be nil
+}
+
+// SendStats counts outbound commands lost to slow clients.
+type SendStats struct {
+	Dropped      atomic.Uint64 // commands dropped under PolicyDrop
+	Disconnected atomic.Uint64 // connections closed for being too slow
+}
+
 type Connection struct {
 	ID            string
 	Conn          net.Conn
-	ClientID      string
+	ClientID      string // set by CONNECT, names durable subscriptions
 	Subscriptions map[string]bool
-	SendChan      chan *protocol.Command
+	Inbox         string              // temporary reply topic, deleted on disconnect
+	Tx            *broker.Transaction // messages staged between BEGIN and COMMIT, nil outside a transaction
+	chunks        *chunkAssembler     // messages published in chunks, being reassembled
+	SendChan      chan outgoing
 	Active        bool
 	Handler       *Handler
+	Config        ConnectionConfig
+	Stats         *SendStats // shared with the server, may be nil
 	mu            sync.Mutex
+
+	done       chan struct{}
+	codec      atomic.Pointer[protocol.Codec] // negotiated at CONNECT, nil sends frames uncompressed
+	dropped    atomic.Uint64                  // commands dropped on this connection
+	unreported atomic.Uint64                  // drops not yet reported to the client
 }
 
-func NewConnection(id string, conn net.Conn) *Connection {
+func NewConnection(id string, conn net.Conn, handler *Handler, cfg ConnectionConfig, stats *SendStats) *Connection {
+	if cfg.SendQueueSize <= 0 {
+		cfg.SendQueueSize = 100
+	}
+	if cfg.SlowClientPolicy == "" {
+		cfg.SlowClientPolicy = PolicyBlock
+	}
+	if cfg.SendTimeout <= 0 {
+		cfg.SendTimeout = 5 * time.Second
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if cfg.MaxChunkBuffer <= 0 {
+		cfg.MaxChunkBuffer = DefaultMaxChunkBuffer
+	}
+	if cfg.CompressionThreshold <= 0 {
+		cfg.CompressionThreshold = protocol.DefaultCompressionThreshold
+	}
+
 	c := &Connection{
 		ID:            id,
 		Conn:          conn,
 		Subscriptions: make(map[string]bool),
-		SendChan:      make(chan *protocol.Command, 100),
+		SendChan:      make(chan outgoing, cfg.SendQueueSize),
 		Active:        true,
-		Handler:       nil,
+		Handler:       handler,
+		Config:        cfg,
+		Stats:         stats,
+		done:          make(chan struct{}),
+		chunks:        newChunkAssembler(cfg.MaxChunkBuffer),
 	}
 
 	go c.reader()
@@ -38,6 +114,12 @@ func NewConnection(id string, conn net.Conn) *Connection {
 }
 
 func (c *Connection) reader() {
+	defer func() {
+		if c.Handler != nil {
+			c.Handler.HandleDisconnect(c)
+		}
+	}()
+
 	for c.IsAlive() {
 		lenBuf := make([]byte, 4)
 		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -53,8 +135,8 @@ func (c *Connection) reader() {
 		}
 		msgLen := binary.BigEndian.Uint32(lenBuf)
 
-		if msgLen > 10*1024*1024 { // 10 MB sanity check
-			log.Printf("[%s] message too large: %d bytes", c.ID, msgLen)
+		if int64(msgLen) > int64(c.Config.MaxFrameSize) {
+			log.Printf("[%s] frame too large: %d bytes, limit %d", c.ID, msgLen, c.Config.MaxFrameSize)
 			c.Close()
 			return
 		}
@@ -83,57 +165,152 @@ func (c *Connection) reader() {
 	}
 }
 func (c *Connection) writer() {
-	for c.IsAlive() {
+	for {
 		select {
-		case cmd, ok := <-c.SendChan:
-			if !ok || cmd == nil {
-				continue
-			}
-
-			data, err := protocol.Encode(cmd)
-			if err != nil {
-				log.Printf("[%s] encode failed: %v", c.ID, err)
+		case <-c.done:
+			return
+		case out := <-c.SendChan:
+			if out.cmd == nil {
 				continue
 			}
-
-			var buf bytes.Buffer
-			binary.Write(&buf, binary.BigEndian, uint32(len(data)))
-			buf.Write(data)
-
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			n, err := c.Conn.Write(buf.Bytes())
-			if err != nil {
-				log.Printf("[%s] write failed (%d bytes): %v", c.ID, n, err)
+			if err := c.write(out.cmd); err != nil {
 				c.Close()
 				return
 			}
+			if out.done != nil {
+				out.done()
+			}
 
-			log.Printf("[%s] sent command %s (%d bytes)", c.ID, cmd.Type, n)
+			// tell the client about commands dropped while its queue was full
+			if n := c.unreported.Swap(0); n > 0 {
+				report := &protocol.Command{
+					Type:    protocol.ERR,
+					Headers: map[string]string{protocol.HeaderCount: strconv.FormatUint(n, 10)},
+					Payload: []byte("send queue full, commands dropped"),
+				}
+				if err := c.write(report); err != nil {
+					c.Close()
+					return
+				}
+			}
 		}
 	}
 }
 
-// Send pushes a command to SendChan safely
+// setCodec compresses the frames sent from now on with codec.
+func (c *Connection) setCodec(codec protocol.Codec) {
+	c.codec.Store(&codec)
+}
+
+// write encodes a command and writes it to the socket with its length prefix,
+// compressing large payloads once a codec was negotiated
+func (c *Connection) write(cmd *protocol.Command) error {
+	var codec protocol.Codec
+	if p := c.codec.Load(); p != nil {
+		codec = *p
+	}
+	data, err := protocol.EncodeCompressed(cmd, codec, c.Config.CompressionThreshold)
+	if err != nil {
+		log.Printf("[%s] encode failed: %v", c.ID, err)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+
+	c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	n, err := c.Conn.Write(buf.Bytes())
+	if err != nil {
+		log.Printf("[%s] write failed (%d bytes): %v", c.ID, n, err)
+		return err
+	}
+
+	log.Printf("[%s] sent command %s (%d bytes)", c.ID, cmd.Type, n)
+	return nil
+}
+
+// Send pushes a command to SendChan, applying the slow client policy when it is full
 func (c *Connection) Send(cmd *protocol.Command) {
+	c.SendThen(cmd, nil)
+}
+
+// SendThen sends cmd like Send and calls done once cmd was written, or dropped
+// under PolicyDrop. done is not called when the connection closes first.
+func (c *Connection) SendThen(cmd *protocol.Command, done func()) {
 	if cmd == nil {
 		log.Printf("[%s] attempted to send nil command, skipping", c.ID)
 		return
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if !c.Active {
+	if !c.IsAlive() {
 		log.Printf("[%s] cannot send, connection inactive", c.ID)
 		return
 	}
 
 	select {
-	case c.SendChan <- cmd:
+	case c.SendChan <- outgoing{cmd, done}:
 		log.Printf("[%s] queued command %s for sending", c.ID, cmd.Type)
+		return
+	case <-c.done:
+		return
 	default:
-		log.Printf("[%s] send channel full, dropping command %s", c.ID, cmd.Type)
 	}
+
+	switch c.Config.SlowClientPolicy {
+	case PolicyDrop:
+		c.dropped.Add(1)
+		c.unreported.Add(1)
+		if c.Stats != nil {
+			c.Stats.Dropped.Add(1)
+		}
+		log.Printf("[%s] send queue full, dropping command %s", c.ID, cmd.Type)
+		if done != nil {
+			done()
+		}
+
+	case PolicyDisconnect:
+		c.disconnectSlow(cmd)
+
+	default:
+		timer := time.NewTimer(c.Config.SendTimeout)
+		defer timer.Stop()
+		select {
+		case c.SendChan <- outgoing{cmd, done}:
+			log.Printf("[%s] queued command %s for sending", c.ID, cmd.Type)
+		case <-c.done:
+		case <-timer.C:
+			c.disconnectSlow(cmd)
+		}
+	}
+}
+
+// disconnectSlow closes a connection whose client stopped reading
+func (c *Connection) disconnectSlow(cmd *protocol.Command) {
+	log.Printf("[%s] send queue full, disconnecting slow client (pending %s)", c.ID, cmd.Type)
+	if c.Stats != nil {
+		c.Stats.Disconnected.Add(1)
+	}
+	c.Close()
+}
+
+// Dropped returns how many commands were dropped on this connection
+func (c *Connection) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// subscriber returns the name the connection's subscriptions are keyed by:
+// its client ID, or the remote address for anonymous clients.
+func (c *Connection) subscriber() string {
+	if c.ClientID != "" {
+		return c.ClientID
+	}
+	return c.ID
+}
+
+// Done is closed once the connection is closed
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
 }
 
 // Close safely closes the connection
@@ -144,7 +321,7 @@ func (c *Connection) Close() {
 	if c.Active {
 		c.Active = false
 		c.Conn.Close()
-		close(c.SendChan)
+		close(c.done)
 		log.Printf("[%s] connection closed", c.ID)
 	}
 }
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"queuego/internal/protocol"
+)
+
+// pipeConnection returns a server connection and the client end of its socket.
+// nothing is read from the client end unless the test does so.
+func pipeConnection(t *testing.T, cfg ConnectionConfig) (*Connection, net.Conn, *SendStats) {
+	t.Helper()
+	server, client := net.Pipe()
+	stats := &SendStats{}
+	conn := NewConnection("test", server, nil, cfg, stats)
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+	return conn, client, stats
+}
+
+// readCommand reads one length-prefixed frame from the client end.
+func readCommand(t *testing.T, client net.Conn) *protocol.Command {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(client, lenBuf); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lenBuf))
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := protocol.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func closed(conn *Connection) bool {
+	select {
+	case <-conn.Done():
+		return true
+	case <-time.After(200 * time.Millisecond):
+		return false
+	}
+}
+
+func TestSlowClientDrop(t *testing.T) {
+	conn, client, stats := pipeConnection(t, ConnectionConfig{SendQueueSize: 2, SlowClientPolicy: PolicyDrop})
+	for i := 0; i < 10; i++ {
+		conn.Send(&protocol.Command{Type: protocol.DELIVER, Topic: "t"})
+	}
+	if conn.Dropped() == 0 || stats.Dropped.Load() != conn.Dropped() {
+		t.Fatalf("dropped %d on the connection, %d in stats", conn.Dropped(), stats.Dropped.Load())
+	}
+	if closed(conn) {
+		t.Fatal("drop policy closed the connection")
+	}
+
+	// the client learns about the drops once it reads again
+	for {
+		cmd := readCommand(t, client)
+		if cmd.Type == protocol.ERR {
+			if cmd.Headers[protocol.HeaderCount] == "" {
+				t.Fatal("drop report has no count")
+			}
+			return
+		}
+	}
+}
+
+func TestSlowClientDisconnect(t *testing.T) {
+	conn, _, stats := pipeConnection(t, ConnectionConfig{SendQueueSize: 2, SlowClientPolicy: PolicyDisconnect})
+	for i := 0; i < 10; i++ {
+		conn.Send(&protocol.Command{Type: protocol.DELIVER, Topic: "t"})
+	}
+	if !closed(conn) {
+		t.Fatal("slow client was not disconnected")
+	}
+	if stats.Disconnected.Load() != 1 {
+		t.Fatalf("Disconnected = %d, want 1", stats.Disconnected.Load())
+	}
+}
+
+func TestSlowClientBlock(t *testing.T) {
+	conn, client, stats := pipeConnection(t, ConnectionConfig{
+		SendQueueSize:    2,
+		SlowClientPolicy: PolicyBlock,
+		SendTimeout:      time.Second,
+	})
+
+	// a client that keeps reading is waited for
+	reading := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, client)
+		close(reading)
+	}()
+	for i := 0; i < 10; i++ {
+		conn.Send(&protocol.Command{Type: protocol.DELIVER, Topic: "t"})
+	}
+	if closed(conn) {
+		t.Fatal("block policy disconnected a client that was reading")
+	}
+	client.SetReadDeadline(time.Now())
+	<-reading
+
+	// one that stops reading is dropped after SendTimeout
+	conn.Config.SendTimeout = 50 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		conn.Send(&protocol.Command{Type: protocol.DELIVER, Topic: "t"})
+	}
+	if !closed(conn) || stats.Disconnected.Load() != 1 {
+		t.Fatalf("stalled client still connected, %d disconnects", stats.Disconnected.Load())
+	}
+}
@@ -1,71 +1,275 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"queuego/internal/broker"
 	"queuego/internal/protocol"
 	"queuego/pkg/types"
+	"strconv"
+	"sync"
 	"time"
 )
 
+var errDelayedInTransaction = errors.New("delayed messages cannot be published in a transaction")
+
 type Handler struct {
 	Broker *broker.Broker
+
+	clients map[string]*Connection // client ID -> connection using it
+	mu      sync.Mutex
 }
 
 func (h *Handler) HandleCommand(conn *Connection, cmd *protocol.Command) {
 	switch cmd.Type {
 
+	case protocol.CONNECT:
+		if id := cmd.Headers[protocol.HeaderClientID]; id != "" {
+			if err := h.claimClientID(conn, id); err != nil {
+				h.sendError(conn, cmd, err)
+				return
+			}
+		}
+		resp := &protocol.Command{
+			Type:      protocol.ACK,
+			MessageID: cmd.MessageID,
+		}
+		if offered := cmd.Headers[protocol.HeaderCompression]; offered != "" {
+			if codec := protocol.Negotiate(offered, conn.Config.Compression); codec != nil {
+				conn.setCodec(codec)
+				resp.Headers = map[string]string{protocol.HeaderCompression: codec.Name()}
+			}
+		}
+		conn.Send(resp)
+		log.Printf("[%s] ACK sent for CONNECT as %q, compression %q", conn.ID, conn.ClientID, resp.Headers[protocol.HeaderCompression])
+
 	case protocol.PUBLISH:
-		msg := &types.Message{
-			Topic:     cmd.Topic,
-			Payload:   cmd.Payload,
-			Timestamp: time.Now(),
-		}
-
-		if err := h.Broker.Publish(cmd.Topic, msg); err != nil {
-			log.Printf("[%s] publish error: %v", conn.ID, err)
-			conn.Send(&protocol.Command{
-				Type:      protocol.ACK,
-				MessageID: cmd.MessageID,
-				Topic:     cmd.Topic,
-				Payload:   []byte(err.Error()),
-			})
+		if isChunk(cmd) {
+			whole, err := conn.chunks.add(cmd, h.Broker.MaxMessageSize(cmd.Topic))
+			if err != nil {
+				h.sendError(conn, cmd, err)
+				return
+			}
+			if whole == nil {
+				conn.Send(publishAck(cmd, nil))
+				log.Printf("[%s] ACK sent for chunk %s/%s of PUBLISH %s", conn.ID,
+					cmd.Headers[protocol.HeaderChunkIndex], cmd.Headers[protocol.HeaderChunkCount], cmd.MessageID)
+				return
+			}
+			cmd = whole
+		}
+
+		msg, deliverAt, err := newMessage(cmd)
+		if err != nil {
+			h.sendError(conn, cmd, err)
+			return
+		}
+
+		if conn.Tx != nil {
+			if deliverAt.After(msg.Timestamp) {
+				h.sendError(conn, cmd, errDelayedInTransaction)
+				return
+			}
+			if err := conn.Tx.Stage(cmd.Topic, msg); err != nil {
+				h.sendError(conn, cmd, err)
+				return
+			}
+			conn.Send(publishAck(cmd, nil))
+			log.Printf("[%s] ACK sent for PUBLISH topic %s staged in transaction", conn.ID, cmd.Topic)
+			return
+		}
+
+		if deliverAt.After(msg.Timestamp) {
+			err = h.Broker.Schedule(cmd.Topic, msg, deliverAt)
+		} else {
+			err = h.Broker.Publish(cmd.Topic, msg)
+		}
+		if err != nil && !errors.Is(err, broker.ErrDuplicate) {
+			h.sendError(conn, cmd, err)
 			return
 		}
 
+		conn.Send(publishAck(cmd, err))
+		if err != nil {
+			log.Printf("[%s] ACK sent for duplicate PUBLISH %s on topic %s", conn.ID, cmd.MessageID, cmd.Topic)
+		} else {
+			log.Printf("[%s] ACK sent for PUBLISH topic %s", conn.ID, cmd.Topic)
+		}
+
+	case protocol.BATCH:
+		cmds, err := protocol.DecodeBatch(cmd.Payload)
+		if err != nil {
+			h.sendError(conn, cmd, err)
+			return
+		}
+		acks := h.publishBatch(conn, cmds)
+		payload, err := protocol.EncodeBatch(acks)
+		if err != nil {
+			h.sendError(conn, cmd, err)
+			return
+		}
 		conn.Send(&protocol.Command{
 			Type:      protocol.ACK,
 			MessageID: cmd.MessageID,
-			Topic:     cmd.Topic,
+			Headers:   map[string]string{protocol.HeaderResults: strconv.Itoa(len(acks))},
+			Payload:   payload,
 		})
-		log.Printf("[%s] ACK sent for PUBLISH topic %s", conn.ID, cmd.Topic)
+		log.Printf("[%s] ACK sent for BATCH of %d messages", conn.ID, len(acks))
 
 	case protocol.SUBSCRIBE:
-		_, err := h.Broker.Subscribe(cmd.Topic, conn.ID)
+		opts := broker.SubscribeOptions{
+			Group:    cmd.Headers[protocol.HeaderGroup],
+			Filter:   cmd.Headers[protocol.HeaderFilter],
+			Offset:   cmd.Headers[protocol.HeaderOffset],
+			Overflow: cmd.Headers[protocol.HeaderOverflow],
+			Durable:  conn.ClientID != "",
+
+			ConfirmWrites: true,
+		}
+		if v, ok := cmd.Headers[protocol.HeaderPrefetch]; ok {
+			prefetch, err := strconv.Atoi(v)
+			if err != nil {
+				h.sendError(conn, cmd, fmt.Errorf("invalid prefetch %q", v))
+				return
+			}
+			opts.Prefetch = prefetch
+		}
+		sub, err := h.Broker.Subscribe(cmd.Topic, conn.subscriber(), opts)
 		if err != nil {
-			log.Printf("[%s] subscribe error: %v", conn.ID, err)
-			conn.Send(&protocol.Command{
-				Type:    protocol.ACK,
-				Topic:   cmd.Topic,
-				Payload: []byte(err.Error()),
-			})
+			h.sendError(conn, cmd, err)
 			return
 		}
 
+		conn.Subscriptions[cmd.Topic] = true
+
+		// the ACK goes out before the first DELIVER of the subscription
 		conn.Send(&protocol.Command{
 			Type:  protocol.ACK,
 			Topic: cmd.Topic,
 		})
 		log.Printf("[%s] ACK sent for SUBSCRIBE topic %s", conn.ID, cmd.Topic)
+		go h.deliver(conn, sub)
 
 	case protocol.UNSUBSCRIBE:
-		h.Broker.Unsubscribe(conn.ID + "-" + cmd.Topic)
+		h.Broker.Unsubscribe(conn.subscriber() + "-" + cmd.Topic)
+		delete(conn.Subscriptions, cmd.Topic)
 		conn.Send(&protocol.Command{
 			Type:  protocol.ACK,
 			Topic: cmd.Topic,
 		})
 		log.Printf("[%s] ACK sent for UNSUBSCRIBE topic %s", conn.ID, cmd.Topic)
 
+	case protocol.ACK:
+		if err := h.Broker.Ack(cmd.Topic, h.subscriptionID(conn, cmd), cmd.MessageID); err != nil {
+			log.Printf("[%s] ack for message %s on topic %s ignored: %v", conn.ID, cmd.MessageID, cmd.Topic, err)
+		}
+
+	case protocol.NACK:
+		opts := broker.NackOptions{
+			Reason:     cmd.Headers[protocol.HeaderReason],
+			DeadLetter: cmd.Headers[protocol.HeaderRequeue] == "false",
+		}
+		if v := cmd.Headers[protocol.HeaderDelay]; v != "" {
+			delay, err := time.ParseDuration(v)
+			if err != nil || delay < 0 {
+				// the message stays in flight and is redelivered once its ack deadline passes
+				log.Printf("[%s] nack for message %s ignored: invalid delay %q", conn.ID, cmd.MessageID, v)
+				return
+			}
+			opts.Delay = delay
+		}
+		if err := h.Broker.Nack(cmd.Topic, h.subscriptionID(conn, cmd), cmd.MessageID, opts); err != nil {
+			log.Printf("[%s] nack for message %s on topic %s ignored: %v", conn.ID, cmd.MessageID, cmd.Topic, err)
+		}
+
+	case protocol.CREDIT:
+		n, err := strconv.Atoi(cmd.Headers[protocol.HeaderCredit])
+		if err != nil || n <= 0 {
+			log.Printf("[%s] credit for topic %s ignored: invalid amount %q", conn.ID, cmd.Topic, cmd.Headers[protocol.HeaderCredit])
+			return
+		}
+		if err := h.Broker.Credit(cmd.Topic, h.subscriptionID(conn, cmd), n); err != nil {
+			log.Printf("[%s] credit for topic %s ignored: %v", conn.ID, cmd.Topic, err)
+		}
+
+	case protocol.REDRIVE:
+		max, _ := strconv.Atoi(cmd.Headers[protocol.HeaderMax])
+		moved, err := h.Broker.Redrive(cmd.Topic, max)
+		resp := &protocol.Command{
+			Type:    protocol.ACK,
+			Topic:   cmd.Topic,
+			Headers: map[string]string{protocol.HeaderCount: strconv.Itoa(moved)},
+		}
+		if err != nil {
+			log.Printf("[%s] redrive error: %v", conn.ID, err)
+			resp.Payload = []byte(err.Error())
+		}
+		conn.Send(resp)
+		log.Printf("[%s] redrove %d messages from %s", conn.ID, moved, cmd.Topic)
+
+	case protocol.INBOX:
+		var sub *broker.Subscription
+		if conn.Inbox == "" {
+			conn.Inbox = h.Broker.CreateInbox(conn.ID)
+			var err error
+			sub, err = h.Broker.Subscribe(conn.Inbox, conn.subscriber(), broker.SubscribeOptions{ConfirmWrites: true})
+			if err != nil {
+				h.sendError(conn, cmd, err)
+				return
+			}
+			conn.Subscriptions[conn.Inbox] = true
+		}
+		conn.Send(&protocol.Command{
+			Type:  protocol.ACK,
+			Topic: conn.Inbox,
+		})
+		log.Printf("[%s] ACK sent for INBOX %s", conn.ID, conn.Inbox)
+		if sub != nil {
+			go h.deliver(conn, sub)
+		}
+
+	case protocol.BEGIN:
+		if conn.Tx != nil {
+			h.sendError(conn, cmd, errors.New("transaction already in progress"))
+			return
+		}
+		conn.Tx = broker.NewTransaction()
+		conn.Send(&protocol.Command{
+			Type: protocol.ACK,
+		})
+		log.Printf("[%s] ACK sent for BEGIN", conn.ID)
+
+	case protocol.COMMIT:
+		tx := conn.Tx
+		if tx == nil {
+			h.sendError(conn, cmd, errors.New("no transaction in progress"))
+			return
+		}
+		conn.Tx = nil
+		if err := h.Broker.Commit(tx); err != nil {
+			h.sendError(conn, cmd, err)
+			return
+		}
+		conn.Send(&protocol.Command{
+			Type:    protocol.ACK,
+			Headers: map[string]string{protocol.HeaderCount: strconv.Itoa(tx.Len())},
+		})
+		log.Printf("[%s] ACK sent for COMMIT of %d messages", conn.ID, tx.Len())
+
+	case protocol.ABORT:
+		if conn.Tx == nil {
+			h.sendError(conn, cmd, errors.New("no transaction in progress"))
+			return
+		}
+		n := conn.Tx.Len()
+		conn.Tx = nil
+		conn.Send(&protocol.Command{
+			Type:    protocol.ACK,
+			Headers: map[string]string{protocol.HeaderCount: strconv.Itoa(n)},
+		})
+		log.Printf("[%s] ACK sent for ABORT, %d staged messages discarded", conn.ID, n)
+
 	case protocol.PING:
 		conn.Send(&protocol.Command{
 			Type: protocol.PONG,
@@ -73,3 +277,305 @@ func (h *Handler) HandleCommand(conn *Connection, cmd *protocol.Command) {
 		log.Printf("[%s] PONG sent", conn.ID)
 	}
 }
+
+// publishBatch publishes the PUBLISH commands of a BATCH frame and returns the ACK
+// answering each of them, in order. messages for immediate delivery reach the broker
+// together, or join the connection's transaction when one is open.
+func (h *Handler) publishBatch(conn *Connection, cmds []*protocol.Command) []*protocol.Command {
+	errs := make([]error, len(cmds))
+	var msgs []*types.Message
+	var pending []int // index in cmds of each message in msgs
+	for i, cmd := range cmds {
+		if cmd.Type != protocol.PUBLISH {
+			errs[i] = fmt.Errorf("%s cannot be batched", cmd.Type)
+			continue
+		}
+		if isChunk(cmd) {
+			errs[i] = errors.New("chunked messages cannot be batched")
+			continue
+		}
+		msg, deliverAt, err := newMessage(cmd)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case conn.Tx != nil && deliverAt.After(msg.Timestamp):
+			errs[i] = errDelayedInTransaction
+		case conn.Tx != nil:
+			errs[i] = conn.Tx.Stage(cmd.Topic, msg)
+		case deliverAt.After(msg.Timestamp):
+			errs[i] = h.Broker.Schedule(cmd.Topic, msg, deliverAt)
+		default:
+			msgs = append(msgs, msg)
+			pending = append(pending, i)
+		}
+	}
+	if len(msgs) > 0 {
+		for j, err := range h.Broker.PublishBatch(msgs) {
+			errs[pending[j]] = err
+		}
+	}
+
+	acks := make([]*protocol.Command, len(cmds))
+	for i, cmd := range cmds {
+		acks[i] = publishAck(cmd, errs[i])
+	}
+	return acks
+}
+
+// publishAck builds the ACK answering a PUBLISH: flagged when the message was a
+// duplicate, and carrying the error text as payload when it failed.
+func publishAck(cmd *protocol.Command, err error) *protocol.Command {
+	ack := &protocol.Command{
+		Type:      protocol.ACK,
+		MessageID: cmd.MessageID,
+		Topic:     cmd.Topic,
+	}
+	if errors.Is(err, broker.ErrDuplicate) {
+		ack.Headers = map[string]string{protocol.HeaderDuplicate: "true"}
+	} else if err != nil {
+		ack.Payload = []byte(err.Error())
+	}
+	return ack
+}
+
+// newMessage builds the message carried by a PUBLISH command and returns the time
+// it should be delivered at, the zero time for immediate delivery.
+func newMessage(cmd *protocol.Command) (*types.Message, time.Time, error) {
+	msg := &types.Message{
+		ID:        cmd.MessageID,
+		Topic:     cmd.Topic,
+		Payload:   cmd.Payload,
+		Headers:   userHeaders(cmd.Headers),
+		Timestamp: time.Now(),
+		Key:       cmd.Headers[protocol.HeaderKey],
+		Retain:    cmd.Headers[protocol.HeaderRetain] == "true",
+
+		ReplyTo:       cmd.Headers[protocol.HeaderReplyTo],
+		CorrelationID: cmd.Headers[protocol.HeaderCorrelationID],
+	}
+	if v, ok := cmd.Headers[protocol.HeaderPriority]; ok {
+		priority, err := strconv.Atoi(v)
+		if err != nil || priority < 0 {
+			return nil, time.Time{}, fmt.Errorf("invalid priority %q", v)
+		}
+		msg.Priority = priority
+	}
+
+	deliverAt, err := parseDeliverAt(cmd.Headers)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if v, ok := cmd.Headers[protocol.HeaderTTL]; ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return nil, time.Time{}, fmt.Errorf("invalid ttl %q", v)
+		}
+		visibleAt := msg.Timestamp
+		if deliverAt.After(visibleAt) {
+			visibleAt = deliverAt
+		}
+		msg.ExpiresAt = visibleAt.Add(ttl)
+	}
+	return msg, deliverAt, nil
+}
+
+// controlHeaders are the PUBLISH headers the broker acts on rather than delivers.
+var controlHeaders = map[string]bool{
+	protocol.HeaderPriority:  true,
+	protocol.HeaderTTL:       true,
+	protocol.HeaderKey:       true,
+	protocol.HeaderRetain:    true,
+	protocol.HeaderDelay:     true,
+	protocol.HeaderDeliverAt: true,
+}
+
+// userHeaders returns the headers of a PUBLISH without its control headers,
+// which newMessage turns into message fields.
+func userHeaders(headers map[string]string) map[string]string {
+	var user map[string]string
+	for k, v := range headers {
+		if controlHeaders[k] {
+			continue
+		}
+		if user == nil {
+			user = make(map[string]string, len(headers))
+		}
+		user[k] = v
+	}
+	return user
+}
+
+// parseDeliverAt reads the delivery time requested by the deliver-at or delay header.
+// it returns the zero time for immediate delivery.
+func parseDeliverAt(headers map[string]string) (time.Time, error) {
+	if v, ok := headers[protocol.HeaderDeliverAt]; ok {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms), nil
+		}
+		at, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid deliver-at %q", v)
+		}
+		return at, nil
+	}
+	if v, ok := headers[protocol.HeaderDelay]; ok {
+		delay, err := time.ParseDuration(v)
+		if err != nil || delay < 0 {
+			return time.Time{}, fmt.Errorf("invalid delay %q", v)
+		}
+		return time.Now().Add(delay), nil
+	}
+	return time.Time{}, nil
+}
+
+// subscriptionID finds the connection's subscription a command refers to: the one
+// named by the subscription header, an exact subscription to the topic, or else
+// a wildcard subscription matching it.
+func (h *Handler) subscriptionID(conn *Connection, cmd *protocol.Command) string {
+	if pattern := cmd.Headers[protocol.HeaderSubscription]; pattern != "" {
+		return conn.subscriber() + "-" + pattern
+	}
+	if !conn.Subscriptions[cmd.Topic] {
+		for pattern := range conn.Subscriptions {
+			if broker.IsWildcard(pattern) && broker.MatchTopic(pattern, cmd.Topic) {
+				return conn.subscriber() + "-" + pattern
+			}
+		}
+	}
+	return conn.subscriber() + "-" + cmd.Topic
+}
+
+// sendError answers a command with an ACK carrying the error text as payload.
+func (h *Handler) sendError(conn *Connection, cmd *protocol.Command, err error) {
+	log.Printf("[%s] %s error: %v", conn.ID, cmd.Type, err)
+	conn.Send(&protocol.Command{
+		Type:      protocol.ACK,
+		MessageID: cmd.MessageID,
+		Topic:     cmd.Topic,
+		Payload:   []byte(err.Error()),
+	})
+}
+
+// HandleDisconnect tears down every subscription and the inbox owned by a closed connection,
+// and discards its open transaction and partially received chunked messages.
+// subscriptions of a connection with a client ID are durable and only detached, to be
+// resumed when the client reconnects and subscribes again.
+func (h *Handler) HandleDisconnect(conn *Connection) {
+	if conn.Tx != nil {
+		log.Printf("[%s] transaction of %d staged messages discarded on disconnect", conn.ID, conn.Tx.Len())
+		conn.Tx = nil
+	}
+	if n := conn.chunks.len(); n > 0 {
+		log.Printf("[%s] %d partially received chunked messages discarded on disconnect", conn.ID, n)
+		conn.chunks.clear()
+	}
+	if conn.Inbox != "" {
+		if err := h.Broker.DeleteTopic(conn.Inbox); err != nil {
+			log.Printf("[%s] deleting inbox %s failed: %v", conn.ID, conn.Inbox, err)
+		}
+		delete(conn.Subscriptions, conn.Inbox)
+		conn.Inbox = ""
+	}
+	for topic := range conn.Subscriptions {
+		if conn.ClientID != "" {
+			h.Broker.Detach(conn.subscriber() + "-" + topic)
+			log.Printf("[%s] durable subscription to topic %s detached on disconnect", conn.ID, topic)
+		} else {
+			h.Broker.Unsubscribe(conn.subscriber() + "-" + topic)
+			log.Printf("[%s] subscription to topic %s removed on disconnect", conn.ID, topic)
+		}
+		delete(conn.Subscriptions, topic)
+	}
+	if conn.ClientID != "" {
+		h.mu.Lock()
+		if h.clients[conn.ClientID] == conn {
+			delete(h.clients, conn.ClientID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// claimClientID binds a client ID to conn. an ID can only be used by one connection at a time,
+// and a connection cannot change its ID once it has subscribed.
+func (h *Handler) claimClientID(conn *Connection, id string) error {
+	if conn.ClientID == id {
+		return nil
+	}
+	if conn.ClientID != "" || len(conn.Subscriptions) > 0 {
+		return errors.New("CONNECT must come before any subscription and cannot change the client ID")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if other, ok := h.clients[id]; ok && other.IsAlive() {
+		return errors.New("client ID " + id + " is already connected")
+	}
+	if h.clients == nil {
+		h.clients = make(map[string]*Connection)
+	}
+	h.clients[id] = conn
+	conn.ClientID = id
+	return nil
+}
+
+// deliver drains a subscription and pushes each message to the client as a DELIVER frame.
+// messages of a wildcard subscription name its pattern in the subscription header,
+// messages of a log topic carry their offset, and messages too large for a frame
+// go out in chunks. it returns once the subscription channel is closed.
+func (h *Handler) deliver(conn *Connection, sub *broker.Subscription) {
+	wildcard := broker.IsWildcard(sub.Topic)
+	logged := !wildcard && h.Broker.IsLogTopic(sub.Topic)
+	for {
+		var msg *types.Message
+		select {
+		case m, ok := <-sub.MessageChannel:
+			if !ok {
+				return
+			}
+			msg = m
+		case <-conn.Done():
+			// a durable subscription outlives the connection
+			return
+		}
+		if msg.IsExpired(time.Now()) {
+			// left in flight, the broker's cleanup expires it
+			continue
+		}
+		offset := logged || (wildcard && h.Broker.IsLogTopic(msg.Topic))
+		headers := msg.Headers
+		if wildcard || offset {
+			headers = make(map[string]string, len(msg.Headers)+2)
+			for k, v := range msg.Headers {
+				headers[k] = v
+			}
+		}
+		if wildcard {
+			headers[protocol.HeaderSubscription] = sub.Topic
+		}
+		if offset {
+			headers[protocol.HeaderOffset] = strconv.FormatInt(msg.Offset, 10)
+		}
+		frames, err := splitDeliver(&protocol.Command{
+			Type:      protocol.DELIVER,
+			Topic:     msg.Topic,
+			MessageID: msg.ID,
+			Headers:   headers,
+			Payload:   msg.Payload,
+		}, conn.Config.MaxFrameSize)
+		// the ack deadline starts once the client was sent the whole message.
+		// a client may ack it first, leaving nothing to start.
+		written := func() { _ = h.Broker.Written(msg.Topic, sub.ID, msg.ID) }
+		if err != nil {
+			// left in flight, the message is redelivered or dead-lettered in time
+			log.Printf("[%s] cannot deliver message %s: %v", conn.ID, msg.ID, err)
+			written()
+			continue
+		}
+		for i, frame := range frames {
+			if i < len(frames)-1 {
+				conn.Send(frame)
+			} else {
+				conn.SendThen(frame, written)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"queuego/internal/broker"
+	"queuego/internal/protocol"
+	"queuego/pkg/types"
+)
+
+// newTestHandler returns a handler over a fresh broker.
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	b := broker.NewBroker(broker.BrokerConfig{
+		MaxQueueSize:       100,
+		CleanupInterval:    time.Minute,
+		AckTimeout:         time.Minute,
+		RedeliveryInterval: time.Minute,
+	})
+	b.Start()
+	t.Cleanup(b.Stop)
+	return &Handler{Broker: b}
+}
+
+// newTestConnection returns a handler over a fresh broker and a connection whose
+// client side discards everything the server sends.
+func newTestConnection(t *testing.T) (*Handler, *Connection) {
+	t.Helper()
+	h := newTestHandler(t)
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	conn := NewConnection("test", server, h, ConnectionConfig{}, &SendStats{})
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+	return h, conn
+}
+
+func TestSubscribeAckedBeforeDelivery(t *testing.T) {
+	h := newTestHandler(t)
+	for i := 0; i < 20; i++ {
+		if err := h.Broker.Publish("jobs", &types.Message{Topic: "jobs", Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, client, _ := pipeConnection(t, ConnectionConfig{})
+	h.HandleCommand(conn, &protocol.Command{Type: protocol.SUBSCRIBE, Topic: "jobs"})
+	if cmd := readCommand(t, client); cmd.Type != protocol.ACK {
+		t.Fatalf("first frame after SUBSCRIBE is %s, want ACK", cmd.Type)
+	}
+	if cmd := readCommand(t, client); cmd.Type != protocol.DELIVER {
+		t.Fatalf("second frame after SUBSCRIBE is %s, want DELIVER", cmd.Type)
+	}
+
+	h.HandleCommand(conn, &protocol.Command{Type: protocol.INBOX})
+	for {
+		cmd := readCommand(t, client)
+		if cmd.Type == protocol.ACK {
+			if cmd.Topic != conn.Inbox {
+				t.Fatalf("INBOX acknowledged with topic %q, want %q", cmd.Topic, conn.Inbox)
+			}
+			break
+		}
+	}
+}
+
+func TestNackWithInvalidDelayIsIgnored(t *testing.T) {
+	h, conn := newTestConnection(t)
+	sub, err := h.Broker.Subscribe("jobs", conn.subscriber(), broker.SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Broker.Publish("jobs", &types.Message{Topic: "jobs", Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-sub.MessageChannel
+
+	for _, delay := range []string{"soon", "-1s"} {
+		h.HandleCommand(conn, &protocol.Command{
+			Type:      protocol.NACK,
+			Topic:     "jobs",
+			MessageID: msg.ID,
+			Headers:   map[string]string{protocol.HeaderDelay: delay},
+		})
+		select {
+		case <-sub.MessageChannel:
+			t.Fatalf("nack with delay %q redelivered the message", delay)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if n := len(sub.Unacked()); n != 1 {
+			t.Fatalf("%d messages awaiting acknowledgement after nack with delay %q, want 1", n, delay)
+		}
+	}
+}
+
+func TestNewMessageStripsControlHeaders(t *testing.T) {
+	msg, deliverAt, err := newMessage(&protocol.Command{
+		Type:  protocol.PUBLISH,
+		Topic: "orders",
+		Headers: map[string]string{
+			protocol.HeaderPriority:      "7",
+			protocol.HeaderTTL:           "1m",
+			protocol.HeaderKey:           "customer-1",
+			protocol.HeaderRetain:        "true",
+			protocol.HeaderDelay:         "1h",
+			protocol.HeaderCorrelationID: "c1",
+			"region":                     "eu",
+		},
+		Payload: []byte("x"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Priority != 7 || msg.Key != "customer-1" || !msg.Retain || msg.ExpiresAt.IsZero() || deliverAt.IsZero() {
+		t.Fatalf("control headers not applied: %+v, deliver at %v", msg, deliverAt)
+	}
+	want := map[string]string{protocol.HeaderCorrelationID: "c1", "region": "eu"}
+	if !reflect.DeepEqual(msg.Headers, want) {
+		t.Fatalf("headers %v, want %v", msg.Headers, want)
+	}
+}
+
+func TestAckDeadlineWaitsForWrite(t *testing.T) {
+	b := broker.NewBroker(broker.BrokerConfig{
+		MaxQueueSize:       100,
+		CleanupInterval:    time.Minute,
+		AckTimeout:         50 * time.Millisecond,
+		RedeliveryInterval: 10 * time.Millisecond,
+	})
+	b.Start()
+	t.Cleanup(b.Stop)
+	h := &Handler{Broker: b}
+	conn, client, _ := pipeConnection(t, ConnectionConfig{})
+	h.HandleCommand(conn, &protocol.Command{Type: protocol.SUBSCRIBE, Topic: "jobs"})
+	readCommand(t, client)
+	if err := b.Publish("jobs", &types.Message{Topic: "jobs", Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client stalls for several ack timeouts before reading
+	time.Sleep(300 * time.Millisecond)
+	first := readCommand(t, client)
+	if first.Type != protocol.DELIVER {
+		t.Fatalf("got %s, want DELIVER", first.Type)
+	}
+	client.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(client, lenBuf); err == nil {
+		t.Fatal("message redelivered while the client was not reading")
+	}
+
+	// once written, an unacknowledged message is redelivered as usual
+	if again := readCommand(t, client); again.Type != protocol.DELIVER || again.MessageID != first.MessageID {
+		t.Fatalf("got %s %s, want DELIVER %s again", again.Type, again.MessageID, first.MessageID)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"net"
 	"queuego/internal/broker"
@@ -12,10 +13,12 @@ type Server struct {
 	Broker      *broker.Broker
 	Handler     *Handler
 	Connections map[string]*Connection
+	Config      ConnectionConfig
+	Stats       SendStats
 	mu          sync.Mutex
 }
 
-func NewServer(addr string, broker *broker.Broker) (*Server, error) {
+func NewServer(addr string, broker *broker.Broker, cfg ConnectionConfig) (*Server, error) {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -26,33 +29,61 @@ func NewServer(addr string, broker *broker.Broker) (*Server, error) {
 		Broker:      broker,
 		Handler:     &Handler{Broker: broker},
 		Connections: make(map[string]*Connection),
+		Config:      cfg,
 	}
 	return s, nil
 }
 
-// Start accepts incoming connections
+// Start accepts incoming connections until the listener is closed
 func (s *Server) Start() {
 	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
-		client := NewConnection(conn.RemoteAddr().String(), conn)
-		client.Handler = s.Handler
+		client := NewConnection(conn.RemoteAddr().String(), conn, s.Handler, s.Config, &s.Stats)
 		log.Printf("New client connected: %s", client.ID)
 
 		s.mu.Lock()
 		s.Connections[client.ID] = client
 		s.mu.Unlock()
+
+		// forget the connection once it is closed
+		go func() {
+			<-client.Done()
+			s.mu.Lock()
+			if s.Connections[client.ID] == client {
+				delete(s.Connections, client.ID)
+			}
+			s.mu.Unlock()
+		}()
 	}
 }
 
+// Dropped returns how many outbound commands were dropped for slow clients
+func (s *Server) Dropped() uint64 {
+	return s.Stats.Dropped.Load()
+}
+
+// Disconnected returns how many slow clients were disconnected
+func (s *Server) Disconnected() uint64 {
+	return s.Stats.Disconnected.Load()
+}
+
 // Stop closes all connections and listener
 func (s *Server) Stop() {
 	s.Listener.Close()
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	conns := make([]*Connection, 0, len(s.Connections))
 	for _, c := range s.Connections {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
 		c.Close()
 	}
+	log.Printf("send stats: %d commands dropped, %d slow clients disconnected", s.Dropped(), s.Disconnected())
 }
@@ -2,106 +2,488 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"queuego/pkg/types"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
+// tombstoneHeader marks a record that deletes the message with the same ID.
+const tombstoneHeader = "x-tombstone"
+
+// defaultSegmentSize is the size in bytes at which a segment is closed, unless
+// NewFileStorage is given another one.
+const defaultSegmentSize = 16 << 20
+
+// file name suffixes used in a storage directory
+const (
+	segmentExt    = ".log"
+	compactingExt = ".tmp"     // compaction output being written
+	compactedExt  = ".compact" // finished compaction output, replaces the segments up to its name
+	legacyLog     = "messages.log"
+)
+
 // FileStorage implements append-only file persistence.
+// each record is a uint32 length followed by a gob encoded message. records are appended
+// to the newest segment; once it reaches the segment size a new one is started.
+// closed segments are compacted in the background, dropping the records that were
+// deleted or, on keyed storage, replaced by a newer message with the same key.
 type FileStorage struct {
-	mu      sync.RWMutex
-	dir     string
-	files   []string
-	maxSize int64
-	offsets map[string]int64 // messageID -> file offset
+	mu          sync.RWMutex
+	dir         string
+	files       []string // segment paths, oldest first; the last one takes appends
+	segmentSize int64
+	keyed       bool                // a message replaces the live message with the same key
+	offsets     map[string]position // messageID -> location of its live record
+	keys        map[string]string   // key -> ID of its live message, keyed storage only
+	keyOf       map[string]string   // messageID -> key, keyed storage only
+	garbage     map[string]int      // segment path -> records no longer live
+
+	compacting sync.Mutex // held while a compaction runs
+}
+
+// position locates a record in a segment.
+type position struct {
+	file   string
+	offset int64
+}
+
+// NewFileStorage opens the storage in dir, closing segments once they reach
+// segmentSize bytes (0 = default).
+func NewFileStorage(dir string, segmentSize int64) (*FileStorage, error) {
+	return openFileStorage(dir, segmentSize, false)
+}
+
+// NewKeyedFileStorage opens a storage where a message replaces the one with the same key,
+// like a changelog: compaction keeps only the latest message per key. messages without
+// a key are kept until deleted.
+func NewKeyedFileStorage(dir string, segmentSize int64) (*FileStorage, error) {
+	return openFileStorage(dir, segmentSize, true)
 }
 
-func NewFileStorage(dir string, maxSize int64) (*FileStorage, error) {
+func openFileStorage(dir string, segmentSize int64, keyed bool) (*FileStorage, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	fs := &FileStorage{
+		dir:         dir,
+		segmentSize: segmentSize,
+		keyed:       keyed,
+		offsets:     make(map[string]position),
+		keys:        make(map[string]string),
+		keyOf:       make(map[string]string),
+		garbage:     make(map[string]int),
+	}
+	if err := fs.recover(); err != nil {
+		return nil, err
+	}
+
+	// rebuild the index from the existing segments
+	for _, path := range fs.files {
+		err := scanFile(path, func(msg *types.Message, offset int64) {
+			fs.index(msg, position{path, offset})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// recover lists the segments, finishing a compaction interrupted by a crash
+// and adopting the single log file written by earlier versions.
+func (fs *FileStorage) recover() error {
+	legacy := filepath.Join(fs.dir, legacyLog)
+	if _, err := os.Stat(legacy); err == nil {
+		if err := os.Rename(legacy, fs.segmentPath(1)); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return err
+	}
+	var compacted []string
+	for _, e := range entries {
+		switch name := e.Name(); {
+		case strings.HasSuffix(name, compactingExt):
+			// incomplete output, the segments it was built from are intact
+			if err := os.Remove(filepath.Join(fs.dir, name)); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, compactedExt):
+			compacted = append(compacted, filepath.Join(fs.dir, name))
+		}
+	}
+	for _, path := range compacted {
+		if err := fs.replaceSegments(path); err != nil {
+			return err
+		}
+	}
+
+	entries, err = os.ReadDir(fs.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if segmentSeq(e.Name()) > 0 {
+			fs.files = append(fs.files, filepath.Join(fs.dir, e.Name()))
+		}
+	}
+	sort.Strings(fs.files)
+	if len(fs.files) == 0 {
+		fs.files = []string{fs.segmentPath(1)}
+	}
+	return nil
+}
 
-	return &FileStorage{
-		dir:     dir,
-		maxSize: maxSize,
-		offsets: make(map[string]int64),
-	}, nil
+// segmentPath returns the path of the segment with sequence number seq.
+// zero padding keeps segments sorted by name.
+func (fs *FileStorage) segmentPath(seq int) string {
+	return filepath.Join(fs.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// segmentSeq returns the sequence number of a segment file name, or 0.
+func segmentSeq(name string) int {
+	seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+	if err != nil || !strings.HasSuffix(name, segmentExt) {
+		return 0
+	}
+	return seq
+}
+
+// index records where the live copy of a message is, applying tombstones
+// and, on keyed storage, replacing the previous message with the same key.
+func (fs *FileStorage) index(msg *types.Message, pos position) {
+	if msg.Headers[tombstoneHeader] != "" {
+		fs.garbage[pos.file]++
+		fs.forget(msg.ID)
+		return
+	}
+	fs.forget(msg.ID)
+	if fs.keyed && msg.Key != "" {
+		if prev, ok := fs.keys[msg.Key]; ok {
+			fs.forget(prev)
+		}
+		fs.keys[msg.Key] = msg.ID
+		fs.keyOf[msg.ID] = msg.Key
+	}
+	fs.offsets[msg.ID] = pos
+}
+
+// forget drops a message from the index, counting its record as garbage.
+func (fs *FileStorage) forget(msgID string) {
+	pos, ok := fs.offsets[msgID]
+	if !ok {
+		return
+	}
+	fs.garbage[pos.file]++
+	delete(fs.offsets, msgID)
+	if key, ok := fs.keyOf[msgID]; ok {
+		delete(fs.keys, key)
+		delete(fs.keyOf, msgID)
+	}
 }
 
 func (fs *FileStorage) Append(msg *types.Message) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	filePath := filepath.Join(fs.dir, "messages.log")
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	pos, err := fs.write(msg)
 	if err != nil {
 		return err
 	}
+	fs.index(msg, pos)
+	return nil
+}
+
+// write appends one record to the active segment and returns its position.
+// a segment that reached the segment size is closed and compaction started.
+func (fs *FileStorage) write(msg *types.Message) (position, error) {
+	record, err := encodeRecord(msg)
+	if err != nil {
+		return position{}, err
+	}
+
+	path := fs.files[len(fs.files)-1]
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return position{}, err
+	}
 	defer file.Close()
 
-	enc := gob.NewEncoder(file)
-	if err := enc.Encode(msg); err != nil {
-		return err
+	info, err := file.Stat()
+	if err != nil {
+		return position{}, err
 	}
-	fs.offsets[msg.ID] = 0
-	return nil
+	if _, err := file.Write(record); err != nil {
+		return position{}, err
+	}
+
+	if info.Size()+int64(len(record)) >= fs.segmentSize {
+		fs.files = append(fs.files, fs.segmentPath(segmentSeq(filepath.Base(path))+1))
+		go func() {
+			if err := fs.Compact(); err != nil {
+				log.Printf("storage %s: compaction failed: %v", fs.dir, err)
+			}
+		}()
+	}
+	return position{path, info.Size()}, nil
 }
 
-func (fs *FileStorage) Retrieve(msgID string) (*types.Message, error) {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
+// encodeRecord frames a message as a uint32 length followed by its gob encoding.
+func encodeRecord(msg *types.Message) ([]byte, error) {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(msg); err != nil {
+		return nil, err
+	}
+	record := make([]byte, 4, 4+body.Len())
+	binary.BigEndian.PutUint32(record, uint32(body.Len()))
+	return append(record, body.Bytes()...), nil
+}
 
-	filePath := filepath.Join(fs.dir, "messages.log")
-	file, err := os.Open(filePath)
+// scanFile calls fn for every record in a segment, in write order.
+func scanFile(path string, fn func(msg *types.Message, offset int64)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
-	dec := gob.NewDecoder(bufio.NewReader(file))
+	r := bufio.NewReader(file)
+	var offset int64
+	lenBuf := make([]byte, 4)
 	for {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			// a torn record at the tail is ignored
+			return nil
+		}
+		n := binary.BigEndian.Uint32(lenBuf)
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil
+		}
+
 		var msg types.Message
-		if err := dec.Decode(&msg); err != nil {
-			break
+		if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&msg); err != nil {
+			return err
 		}
-		if msg.ID == msgID {
-			return &msg, nil
+		fn(&msg, offset)
+		offset += 4 + int64(n)
+	}
+}
+
+// scan calls fn for every live message, in write order. callers hold fs.mu.
+func (fs *FileStorage) scan(fn func(msg *types.Message)) error {
+	for _, path := range fs.files {
+		err := scanFile(path, func(msg *types.Message, offset int64) {
+			if fs.offsets[msg.ID] == (position{path, offset}) {
+				fn(msg)
+			}
+		})
+		if err != nil {
+			return err
 		}
 	}
-	return nil, os.ErrNotExist
+	return nil
 }
 
-func (fs *FileStorage) Delete(msgID string) error {
+// Compact rewrites the closed segments into one, keeping only the live records.
+// appends go to the active segment meanwhile and are not blocked; the index is
+// only locked to swap the files in. it runs automatically whenever a segment is closed.
+func (fs *FileStorage) Compact() error {
+	fs.compacting.Lock()
+	defer fs.compacting.Unlock()
+
+	fs.mu.RLock()
+	closed := append([]string(nil), fs.files[:len(fs.files)-1]...)
+	dead := 0
+	for _, path := range closed {
+		dead += fs.garbage[path]
+	}
+	fs.mu.RUnlock()
+	if dead == 0 {
+		return nil
+	}
+
+	// the output takes the place of the newest closed segment
+	target := closed[len(closed)-1]
+	out, err := os.Create(target + compactingExt)
+	if err != nil {
+		return err
+	}
+	type move struct{ from, to position }
+	moves := make(map[string]move)
+	var size int64
+	for _, path := range closed {
+		var werr error
+		err = scanFile(path, func(msg *types.Message, offset int64) {
+			from := position{path, offset}
+			fs.mu.RLock()
+			live := fs.offsets[msg.ID] == from
+			fs.mu.RUnlock()
+			if !live || werr != nil {
+				return
+			}
+			var record []byte
+			if record, werr = encodeRecord(msg); werr != nil {
+				return
+			}
+			if _, werr = out.Write(record); werr != nil {
+				return
+			}
+			moves[msg.ID] = move{from, position{target, size}}
+			size += int64(len(record))
+		})
+		if err == nil {
+			err = werr
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(target + compactingExt)
+		return err
+	}
+	// from here on a restart completes the swap
+	if err := os.Rename(target+compactingExt, target+compactedExt); err != nil {
+		return err
+	}
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	delete(fs.offsets, msgID)
-	// actual log compaction would be needed
+	if err := fs.replaceSegments(target + compactedExt); err != nil {
+		return err
+	}
+	for id, m := range moves {
+		// messages deleted or replaced during the compaction stay that way
+		if fs.offsets[id] == m.from {
+			fs.offsets[id] = m.to
+		}
+	}
+	fs.files = fs.files[len(closed)-1:]
+	for _, path := range closed {
+		delete(fs.garbage, path)
+	}
+	// records that died while compacting were copied and are garbage again
+	for id, m := range moves {
+		if fs.offsets[id] != m.to {
+			fs.garbage[target]++
+		}
+	}
 	return nil
 }
 
-func (fs *FileStorage) List(topic string) ([]*types.Message, error) {
+// replaceSegments swaps a finished compaction output in for the segment it is named
+// after, removing the older segments it replaces.
+func (fs *FileStorage) replaceSegments(compacted string) error {
+	target := strings.TrimSuffix(compacted, compactedExt)
+	last := segmentSeq(filepath.Base(target))
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if seq := segmentSeq(e.Name()); seq > 0 && seq < last {
+			if err := os.Remove(filepath.Join(fs.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(compacted, target)
+}
+
+func (fs *FileStorage) Retrieve(msgID string) (*types.Message, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
-	var result []*types.Message
-	filePath := filepath.Join(fs.dir, "messages.log")
-	file, err := os.Open(filePath)
+	pos, ok := fs.offsets[msgID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	var found *types.Message
+	err := scanFile(pos.file, func(msg *types.Message, at int64) {
+		if at == pos.offset {
+			found = msg
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if found == nil {
+		return nil, os.ErrNotExist
+	}
+	return found, nil
+}
 
-	dec := gob.NewDecoder(bufio.NewReader(file))
-	for {
-		var msg types.Message
-		if err := dec.Decode(&msg); err != nil {
-			break
-		}
+// Delete writes a tombstone so the message stays deleted after a restart.
+// compaction removes both once their segments are closed.
+func (fs *FileStorage) Delete(msgID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.offsets[msgID]; !ok {
+		return nil
+	}
+	tombstone := &types.Message{
+		ID:      msgID,
+		Headers: map[string]string{tombstoneHeader: "true"},
+	}
+	pos, err := fs.write(tombstone)
+	if err != nil {
+		return err
+	}
+	fs.index(tombstone, pos)
+	return nil
+}
+
+func (fs *FileStorage) List(topic string) ([]*types.Message, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var result []*types.Message
+	err := fs.scan(func(msg *types.Message) {
 		if msg.Topic == topic {
-			result = append(result, &msg)
+			result = append(result, msg)
 		}
-	}
-	return result, nil
+	})
+	return result, err
+}
+
+// All returns every live message in the log, in write order.
+func (fs *FileStorage) All() ([]*types.Message, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var result []*types.Message
+	err := fs.scan(func(msg *types.Message) {
+		result = append(result, msg)
+	})
+	return result, err
 }
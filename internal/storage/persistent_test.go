@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"queuego/pkg/types"
+)
+
+// testSegmentSize closes a segment after two or three test messages.
+const testSegmentSize = 300
+
+func open(t *testing.T, dir string, keyed bool) *FileStorage {
+	t.Helper()
+	openStorage := NewFileStorage
+	if keyed {
+		openStorage = NewKeyedFileStorage
+	}
+	fs, err := openStorage(dir, testSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func appendMessages(t *testing.T, fs *FileStorage, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		msg := &types.Message{ID: id, Topic: "t", Payload: []byte(strings.Repeat("x", 100))}
+		if err := fs.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func ids(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprint("m", i)
+	}
+	return ids
+}
+
+// live returns the IDs of the messages in fs, in write order.
+func live(t *testing.T, fs *FileStorage) []string {
+	t.Helper()
+	msgs, err := fs.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// files returns the names of the files in dir with the given suffix, sorted.
+func files(t *testing.T, dir, suffix string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), suffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectLive(t *testing.T, fs *FileStorage, want []string) {
+	t.Helper()
+	if got := live(t, fs); !reflect.DeepEqual(got, want) {
+		t.Fatalf("live messages %v, want %v", got, want)
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	fs := open(t, dir, false)
+	appendMessages(t, fs, ids(10)...)
+
+	if n := len(files(t, dir, segmentExt)); n < 3 {
+		t.Fatalf("%d segments after 10 messages, want several", n)
+	}
+	expectLive(t, fs, ids(10))
+	expectLive(t, open(t, dir, false), ids(10))
+}
+
+func TestDeleteSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs := open(t, dir, false)
+	appendMessages(t, fs, "a", "b", "c")
+	if err := fs.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	expectLive(t, fs, []string{"a", "c"})
+
+	fs = open(t, dir, false)
+	expectLive(t, fs, []string{"a", "c"})
+	if _, err := fs.Retrieve("b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Retrieve of a deleted message returned %v", err)
+	}
+	msg, err := fs.Retrieve("c")
+	if err != nil || msg.ID != "c" {
+		t.Fatalf("Retrieve returned %v, %v", msg, err)
+	}
+}
+
+func TestTornRecordIgnored(t *testing.T) {
+	dir := t.TempDir()
+	fs := open(t, dir, false)
+	appendMessages(t, fs, ids(5)...)
+
+	// a crash in the middle of the last write leaves part of a record behind
+	segments := files(t, dir, segmentExt)
+	last := filepath.Join(dir, segments[len(segments)-1])
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	expectLive(t, open(t, dir, false), ids(4))
+}
+
+func TestKeyedReplacement(t *testing.T) {
+	dir := t.TempDir()
+	fs := open(t, dir, true)
+	for i, key := range []string{"k1", "k2", "k1", "", "k2"} {
+		msg := &types.Message{ID: fmt.Sprint("m", i), Topic: "t", Key: key, Payload: []byte(fmt.Sprint(i))}
+		if err := fs.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// messages without a key are never replaced
+	want := []string{"m2", "m3", "m4"}
+	expectLive(t, fs, want)
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	expectLive(t, fs, want)
+	expectLive(t, open(t, dir, true), want)
+}
+
+func TestCompactDropsDeadRecords(t *testing.T) {
+	dir := t.TempDir()
+	fs := open(t, dir, false)
+	appendMessages(t, fs, ids(12)...)
+	for _, id := range ids(10) {
+		if err := fs.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := len(files(t, dir, segmentExt))
+	if err := fs.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := len(files(t, dir, segmentExt)); after >= before {
+		t.Fatalf("%d segments after compaction, %d before", after, before)
+	}
+	if leftovers := append(files(t, dir, compactingExt), files(t, dir, compactedExt)...); len(leftovers) > 0 {
+		t.Fatalf("compaction left %v behind", leftovers)
+	}
+	want := []string{"m10", "m11"}
+	expectLive(t, fs, want)
+	expectLive(t, open(t, dir, false), want)
+}
+
+// crashDuringCompaction fills a storage with closed segments and returns the closed
+// segments, oldest first, as a compaction would replace them.
+func crashDuringCompaction(t *testing.T, dir string) []string {
+	t.Helper()
+	appendMessages(t, open(t, dir, false), ids(8)...)
+	segments := files(t, dir, segmentExt)
+	if len(segments) < 3 {
+		t.Fatalf("%d segments, want at least 3", len(segments))
+	}
+	return segments[:len(segments)-1]
+}
+
+// concat writes the records of segments into name, like a compaction output
+// of segments where every record is still live.
+func concat(t *testing.T, dir, name string, segments []string) {
+	t.Helper()
+	var data []byte
+	for _, s := range segments {
+		b, err := os.ReadFile(filepath.Join(dir, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverDiscardsUnfinishedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	closed := crashDuringCompaction(t, dir)
+	target := closed[len(closed)-1]
+	if err := os.WriteFile(filepath.Join(dir, target+compactingExt), []byte("torn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := open(t, dir, false)
+	if tmp := files(t, dir, compactingExt); len(tmp) > 0 {
+		t.Fatalf("%v not removed on open", tmp)
+	}
+	expectLive(t, fs, ids(8))
+}
+
+func TestRecoverFinishesCompaction(t *testing.T) {
+	dir := t.TempDir()
+	closed := crashDuringCompaction(t, dir)
+	target := closed[len(closed)-1]
+	concat(t, dir, target+compactedExt, closed)
+
+	fs := open(t, dir, false)
+	for _, s := range closed[:len(closed)-1] {
+		if _, err := os.Stat(filepath.Join(dir, s)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("segment %s replaced by the compaction still exists", s)
+		}
+	}
+	if c := files(t, dir, compactedExt); len(c) > 0 {
+		t.Fatalf("%v not swapped in on open", c)
+	}
+	expectLive(t, fs, ids(8))
+	expectLive(t, open(t, dir, false), ids(8))
+}
+
+func TestRecoverInterruptedSwap(t *testing.T) {
+	dir := t.TempDir()
+	closed := crashDuringCompaction(t, dir)
+	target := closed[len(closed)-1]
+	concat(t, dir, target+compactedExt, closed)
+	// the crash hit while the replaced segments were being removed
+	if err := os.Remove(filepath.Join(dir, closed[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := open(t, dir, false)
+	expectLive(t, fs, ids(8))
+	appendMessages(t, fs, "after")
+	expectLive(t, open(t, dir, false), append(ids(8), "after"))
+}
+
+func TestAdoptLegacyLog(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendMessages(t, fs, "a", "b")
+	if err := os.Rename(filepath.Join(dir, files(t, dir, segmentExt)[0]), filepath.Join(dir, legacyLog)); err != nil {
+		t.Fatal(err)
+	}
+	expectLive(t, open(t, dir, false), []string{"a", "b"})
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+// Package testutil holds helpers shared by the tests of several packages.
+package testutil
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// CPUTime returns the CPU time the process used so far.
+func CPUTime(tb testing.TB) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		tb.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
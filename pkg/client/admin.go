@@ -0,0 +1,48 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"queuego/internal/protocol"
+	"strconv"
+)
+
+// Admin issues management commands to the broker.
+type Admin struct {
+	*Client
+}
+
+func NewAdmin(cfg ClientConfig) *Admin {
+	return &Admin{
+		Client: &Client{
+			Config: cfg,
+			active: false,
+		},
+	}
+}
+
+// Redrive moves up to max messages (0 = all) from a dead-letter topic back to
+// their original topics and returns how many were moved.
+func (a *Admin) Redrive(dlqTopic string, max int) (int, error) {
+	cmd := &protocol.Command{
+		Type:    protocol.REDRIVE,
+		Topic:   dlqTopic,
+		Headers: map[string]string{protocol.HeaderMax: strconv.Itoa(max)},
+	}
+	if err := a.SendCommand(cmd); err != nil {
+		return 0, err
+	}
+
+	resp, err := a.ReadResponse()
+	if err != nil {
+		return 0, err
+	}
+	if resp.Type != protocol.ACK {
+		return 0, fmt.Errorf("redrive failed, got type %s", resp.Type)
+	}
+	moved, _ := strconv.Atoi(resp.Headers[protocol.HeaderCount])
+	if len(resp.Payload) > 0 {
+		return moved, errors.New(string(resp.Payload))
+	}
+	return moved, nil
+}
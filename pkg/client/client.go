@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"queuego/internal/protocol"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,6 +18,22 @@ type ClientConfig struct {
 	RetryMax      int
 	RetryInterval time.Duration
 	ConnTimeout   time.Duration
+
+	// ClientID identifies the client across connections. when set, its subscriptions
+	// are durable: the broker keeps collecting their messages while the client is
+	// disconnected and resumes delivery once it subscribes again with the same ID.
+	ClientID string
+
+	// Compression lists the codecs offered to the broker, by preference, e.g. {"gzip"}.
+	// once the broker picks one, payloads of at least CompressionThreshold bytes
+	// (0 = protocol.DefaultCompressionThreshold) are compressed in both directions.
+	Compression          []string
+	CompressionThreshold int
+
+	// ChunkSize splits larger payloads into chunks of this many bytes, which the broker
+	// reassembles into one message. 0 = protocol.DefaultChunkSize. it must stay below
+	// the broker's max frame size.
+	ChunkSize int
 }
 
 type Client struct {
@@ -25,6 +43,7 @@ type Client struct {
 	mu          sync.Mutex
 	subscribers map[string]func(*protocol.Command) // topic -> handler
 	active      bool
+	codec       protocol.Codec // negotiated at CONNECT, nil sends frames uncompressed
 }
 
 func (c *Client) Connect(address string) error {
@@ -35,9 +54,11 @@ func (c *Client) Connect(address string) error {
 		log.Printf("Attempting to connect to %s (try %d/%d)", address, attempt+1, c.Config.RetryMax)
 		c.Conn, err = net.DialTimeout("tcp", address, c.Config.ConnTimeout)
 		if err == nil {
+			c.mu.Lock()
 			c.active = true
+			c.mu.Unlock()
 			log.Printf("Successfully connected to %s", address)
-			return nil
+			return c.hello()
 		}
 		log.Printf("Connection failed: %v. Retrying in %s...", err, c.Config.RetryInterval*(1<<attempt))
 		time.Sleep(c.Config.RetryInterval * (1 << attempt))
@@ -46,6 +67,56 @@ func (c *Client) Connect(address string) error {
 	return err
 }
 
+// hello sends a CONNECT frame when the client has a client ID to claim
+// or compression to negotiate.
+func (c *Client) hello() error {
+	c.setCodec(nil)
+	if c.Config.ClientID == "" && len(c.Config.Compression) == 0 {
+		return nil
+	}
+	headers := make(map[string]string)
+	if c.Config.ClientID != "" {
+		headers[protocol.HeaderClientID] = c.Config.ClientID
+	}
+	if len(c.Config.Compression) > 0 {
+		headers[protocol.HeaderCompression] = strings.Join(c.Config.Compression, ",")
+	}
+	if err := c.SendCommand(&protocol.Command{Type: protocol.CONNECT, Headers: headers}); err != nil {
+		return err
+	}
+	resp, err := c.ReadResponse()
+	if err != nil {
+		return err
+	}
+	if resp.Type != protocol.ACK || len(resp.Payload) > 0 {
+		c.Disconnect()
+		return fmt.Errorf("connect as %q rejected: %s", c.Config.ClientID, resp.Payload)
+	}
+	if name := resp.Headers[protocol.HeaderCompression]; name != "" {
+		codec, ok := protocol.LookupCodec(name)
+		if !ok {
+			c.Disconnect()
+			return fmt.Errorf("broker chose unknown compression %q", name)
+		}
+		c.setCodec(codec)
+	}
+	return nil
+}
+
+// connected reports whether the client holds a connection that Disconnect did not close.
+func (c *Client) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+// setCodec compresses the frames sent from now on with codec, nil disables compression.
+func (c *Client) setCodec(codec protocol.Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = codec
+}
+
 func (c *Client) Disconnect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -78,7 +149,14 @@ func EncodeWithLength(cmd *protocol.Command) ([]byte, error) {
 }
 
 func (c *Client) SendCommand(cmd *protocol.Command) error {
-	data, err := protocol.Encode(cmd)
+	c.mu.Lock()
+	codec := c.codec
+	c.mu.Unlock()
+	threshold := c.Config.CompressionThreshold
+	if threshold <= 0 {
+		threshold = protocol.DefaultCompressionThreshold
+	}
+	data, err := protocol.EncodeCompressed(cmd, codec, threshold)
 	if err != nil {
 		return err
 	}
@@ -1,13 +1,45 @@
 package client
 
 import (
+	"errors"
+	"log"
 	"queuego/internal/protocol"
+	"strconv"
 	"time"
 )
 
 type Consumer struct {
 	*Client
 	bufferSze int
+	reading   bool
+
+	// ManualAck disables acknowledging messages after the handler returns;
+	// the handler must then call Ack or Nack itself.
+	ManualAck bool
+
+	// Prefetch caps how many unacknowledged messages the broker sends per
+	// subscription, 0 = unlimited. use Credit to raise it on the fly.
+	Prefetch int
+
+	// Filter is a filter expression the broker applies to new subscriptions,
+	// e.g. "region = 'eu' AND priority > 5". messages that do not match are never sent.
+	Filter string
+
+	// Offset is where new subscriptions to log topics start reading: "earliest",
+	// "latest" (the default), an offset, or an RFC 3339 time.
+	Offset string
+
+	// Overflow is what new subscriptions do when they fall so far behind that their
+	// outbox on the broker is full: "drop" misses messages, "spill" lets the outbox grow.
+	// empty uses the topic's default.
+	Overflow string
+}
+
+// NackOptions controls how the broker treats a rejected message.
+type NackOptions struct {
+	Delay      time.Duration // wait before redelivery, 0 = redeliver immediately
+	Reason     string        // recorded on the message if it is dead-lettered
+	DeadLetter bool          // do not redeliver, move straight to the dead-letter topic
 }
 
 func NewConsumer(cfg ClientConfig) *Consumer {
@@ -18,52 +50,230 @@ func NewConsumer(cfg ClientConfig) *Consumer {
 		},
 	}
 }
+
+// Subscribe registers handler for topic. topic may be a pattern such as "orders.*.created"
+// or "orders.>", which also follows matching topics created later.
 func (c *Consumer) Subscribe(topic string, handler func(msg *protocol.Command)) error {
+	return c.SubscribeGroup(topic, "", handler)
+}
+
+// SubscribeGroup joins a consumer group on topic. consumers in the same group
+// share the topic's messages, each message being delivered to only one of them.
+func (c *Consumer) SubscribeGroup(topic, group string, handler func(msg *protocol.Command)) error {
 	cmd := &protocol.Command{
 		Type:  protocol.SUBSCRIBE,
 		Topic: topic,
 	}
-
-	if err := c.SendCommand(cmd); err != nil {
-		return err
+	cmd.Headers = map[string]string{}
+	if group != "" {
+		cmd.Headers[protocol.HeaderGroup] = group
+	}
+	if c.Prefetch > 0 {
+		cmd.Headers[protocol.HeaderPrefetch] = strconv.Itoa(c.Prefetch)
+	}
+	if c.Filter != "" {
+		cmd.Headers[protocol.HeaderFilter] = c.Filter
+	}
+	if c.Offset != "" {
+		cmd.Headers[protocol.HeaderOffset] = c.Offset
+	}
+	if c.Overflow != "" {
+		cmd.Headers[protocol.HeaderOverflow] = c.Overflow
 	}
 
-	// track subscriber
+	// track subscriber before the broker can start delivering
 	c.mu.Lock()
 	if c.subscribers == nil {
 		c.subscribers = make(map[string]func(*protocol.Command))
 	}
 	c.subscribers[topic] = handler
+	startLoop := !c.reading
+	c.reading = true
 	c.mu.Unlock()
 
-	// start goroutine to read messages
-	go c.readLoop(topic, handler)
+	if err := c.SendCommand(cmd); err != nil {
+		c.mu.Lock()
+		delete(c.subscribers, topic)
+		c.mu.Unlock()
+		return err
+	}
+
+	// a single goroutine reads the connection and dispatches to all handlers
+	if startLoop {
+		go c.readLoop()
+	}
 	return nil
 }
 
-func (c *Consumer) readLoop(topic string, handler func(msg *protocol.Command)) {
-	for c.active {
+func (c *Consumer) readLoop() {
+	chunks := make(deliveryChunks)
+	for c.connected() {
 		msg, err := c.ReadResponse()
 		if err != nil {
+			// chunks read so far are resent from the start after a reconnect
+			clear(chunks)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		if msg.Topic != topic {
+		if msg.Type == protocol.ERR {
+			log.Printf("broker reported an error (%s): %s", msg.Headers[protocol.HeaderCount], msg.Payload)
+			continue
+		}
+		if msg.Type == protocol.ACK && len(msg.Payload) > 0 {
+			log.Printf("broker rejected request on topic %s: %s", msg.Topic, msg.Payload)
+			continue
+		}
+		if msg.Type != protocol.DELIVER {
+			continue
+		}
+		if msg = chunks.add(msg); msg == nil {
+			continue
+		}
+
+		// wildcard subscriptions are registered under their pattern
+		key := msg.Topic
+		if pattern := msg.Headers[protocol.HeaderSubscription]; pattern != "" {
+			key = pattern
+		}
+		c.mu.Lock()
+		handler, ok := c.subscribers[key]
+		c.mu.Unlock()
+		if !ok {
 			continue
 		}
 
 		handler(msg)
 
-		// send ACK -- use proper ACK command type
-		ack := &protocol.Command{
-			Type:      protocol.ACK,
-			MessageID: msg.MessageID,
-			Topic:     topic,
+		if !c.ManualAck {
+			_ = c.ack(msg)
 		}
-		_ = c.SendCommand(ack)
 	}
 }
 
+// chunkedDelivery collects the chunks of a message the broker delivers in pieces.
+type chunkedDelivery struct {
+	first   *protocol.Command // carries the topic and headers of the whole message
+	payload []byte
+	next    int // index of the chunk expected next
+	count   int
+}
+
+// deliveryChunks reassembles messages too large for one DELIVER frame, by subscription
+// and message ID. the broker sends the chunks of a message one after the other.
+type deliveryChunks map[string]*chunkedDelivery
+
+// add returns msg itself unless it is a chunk, the whole message once its last chunk
+// arrived, or nil while chunks are missing. a chunk out of sequence drops the partial
+// message, which the broker redelivers once its ack deadline passes.
+func (d deliveryChunks) add(msg *protocol.Command) *protocol.Command {
+	if _, ok := msg.Headers[protocol.HeaderChunkCount]; !ok {
+		return msg
+	}
+	id := msg.Headers[protocol.HeaderSubscription] + "\x00" + msg.Topic + "\x00" + msg.MessageID
+	index, err1 := strconv.Atoi(msg.Headers[protocol.HeaderChunkIndex])
+	count, err2 := strconv.Atoi(msg.Headers[protocol.HeaderChunkCount])
+	m, ok := d[id]
+	switch {
+	case err1 != nil || err2 != nil || count < 1 || index < 0 || index >= count:
+		log.Printf("dropping DELIVER of message %s with an invalid chunk %q of %q", msg.MessageID,
+			msg.Headers[protocol.HeaderChunkIndex], msg.Headers[protocol.HeaderChunkCount])
+		delete(d, id)
+		return nil
+	case index == 0:
+		m = &chunkedDelivery{first: msg, count: count}
+		d[id] = m
+	case !ok || index != m.next || count != m.count:
+		log.Printf("dropping message %s: chunk %d arrived out of sequence", msg.MessageID, index)
+		delete(d, id)
+		return nil
+	}
+
+	m.payload = append(m.payload, msg.Payload...)
+	m.next++
+	if m.next < m.count {
+		return nil
+	}
+	delete(d, id)
+	headers := make(map[string]string, len(m.first.Headers))
+	for k, v := range m.first.Headers {
+		if k != protocol.HeaderChunkIndex && k != protocol.HeaderChunkCount {
+			headers[k] = v
+		}
+	}
+	return &protocol.Command{
+		Type:      protocol.DELIVER,
+		Topic:     m.first.Topic,
+		MessageID: m.first.MessageID,
+		Headers:   headers,
+		Payload:   m.payload,
+	}
+}
+
+// Ack acknowledges a delivered message.
+func (c *Consumer) Ack(topic, messageID string) error {
+	return c.SendCommand(&protocol.Command{
+		Type:      protocol.ACK,
+		MessageID: messageID,
+		Topic:     topic,
+	})
+}
+
+// ack acknowledges a DELIVER frame, naming the wildcard subscription it came through.
+func (c *Consumer) ack(msg *protocol.Command) error {
+	cmd := &protocol.Command{
+		Type:      protocol.ACK,
+		MessageID: msg.MessageID,
+		Topic:     msg.Topic,
+	}
+	if pattern := msg.Headers[protocol.HeaderSubscription]; pattern != "" {
+		cmd.Headers = map[string]string{protocol.HeaderSubscription: pattern}
+	}
+	return c.SendCommand(cmd)
+}
+
+// Reply answers a request delivered with a reply-to header, copying its correlation ID.
+func (c *Consumer) Reply(request *protocol.Command, payload []byte) error {
+	replyTo := request.Headers[protocol.HeaderReplyTo]
+	if replyTo == "" {
+		return errors.New("message " + request.MessageID + " has no reply-to")
+	}
+	return c.SendCommand(&protocol.Command{
+		Type:    protocol.PUBLISH,
+		Topic:   replyTo,
+		Headers: map[string]string{protocol.HeaderCorrelationID: request.Headers[protocol.HeaderCorrelationID]},
+		Payload: payload,
+	})
+}
+
+// Nack rejects a delivered message so the broker redelivers or dead-letters it.
+func (c *Consumer) Nack(topic, messageID string, opts NackOptions) error {
+	headers := map[string]string{}
+	if opts.Delay > 0 {
+		headers[protocol.HeaderDelay] = opts.Delay.String()
+	}
+	if opts.Reason != "" {
+		headers[protocol.HeaderReason] = opts.Reason
+	}
+	if opts.DeadLetter {
+		headers[protocol.HeaderRequeue] = "false"
+	}
+	return c.SendCommand(&protocol.Command{
+		Type:      protocol.NACK,
+		MessageID: messageID,
+		Topic:     topic,
+		Headers:   headers,
+	})
+}
+
+// Credit allows the broker to send n more messages on topic beyond the prefetch window.
+func (c *Consumer) Credit(topic string, n int) error {
+	return c.SendCommand(&protocol.Command{
+		Type:    protocol.CREDIT,
+		Topic:   topic,
+		Headers: map[string]string{protocol.HeaderCredit: strconv.Itoa(n)},
+	})
+}
+
 func (c *Consumer) Unsubscribe(topic string) error {
 	cmd := &protocol.Command{
 		Type:  protocol.UNSUBSCRIBE,
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"queuego/internal/protocol"
+	"queuego/internal/server"
+	"queuego/pkg/types"
+)
+
+func TestDeliverLargerThanFrame(t *testing.T) {
+	const maxFrame = 64 * 1024
+	addr := startServerWith(t, server.ConnectionConfig{MaxFrameSize: maxFrame})
+	cfg := ClientConfig{RetryMax: 1, RetryInterval: time.Second, ConnTimeout: time.Second, ChunkSize: 16 * 1024}
+
+	c := NewConsumer(cfg)
+	if err := c.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	got := make(chan *protocol.Command, 1)
+	if err := c.Subscribe("files", func(m *protocol.Command) { got <- m }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	p := NewProducer(cfg)
+	if err := p.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Disconnect()
+	payload := make([]byte, 5*maxFrame+123)
+	rand.New(rand.NewSource(1)).Read(payload)
+	if err := p.PublishMessage(&types.Message{Topic: "files", Payload: payload, Headers: map[string]string{"name": "big.bin"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-got:
+		if !bytes.Equal(msg.Payload, payload) {
+			t.Fatalf("received %d bytes, want the %d published", len(msg.Payload), len(payload))
+		}
+		if msg.Headers["name"] != "big.bin" {
+			t.Fatalf("headers %v lost the message's name", msg.Headers)
+		}
+		if _, ok := msg.Headers[protocol.HeaderChunkCount]; ok {
+			t.Fatalf("reassembled message still has chunk headers: %v", msg.Headers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("large message not delivered")
+	}
+}
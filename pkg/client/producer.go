@@ -1,13 +1,21 @@
 package client
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"queuego/internal/protocol"
 	"queuego/pkg/types"
+	"strconv"
+	"sync/atomic"
 )
 
 type Producer struct {
 	*Client
+	ID  string // prefix of the message IDs this producer assigns
+	seq atomic.Uint64
 }
 
 func NewProducer(cfg ClientConfig) *Producer {
@@ -16,45 +24,245 @@ func NewProducer(cfg ClientConfig) *Producer {
 			Config: cfg,
 			active: false,
 		},
+		ID: newProducerID(),
 	}
 }
+
+// newProducerID returns a random identifier for a producer instance.
+func newProducerID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// nextMessageID returns the producer ID followed by the next sequence number.
+func (p *Producer) nextMessageID() string {
+	return p.ID + "-" + strconv.FormatUint(p.seq.Add(1), 10)
+}
 func (p *Producer) Publish(topic string, payload []byte) error {
 	msg := &types.Message{
 		Topic:   topic,
 		Payload: payload,
 	}
-	cmd := &protocol.Command{
-		Type:    protocol.PUBLISH,
-		Topic:   topic,
-		Payload: msg.Payload,
-	}
+	return p.PublishMessage(msg)
+}
 
-	// send the command over TCP connection
-	if err := p.SendCommand(cmd); err != nil {
-		return err
+// PublishMessage sends a fully described message, carrying its ID, headers, priority and key.
+// messages without an ID get one from the producer, so a publish retried after a
+// lost connection is dropped by the broker's dedup window instead of enqueued twice.
+func (p *Producer) PublishMessage(msg *types.Message) error {
+	cmd := p.publishCommand(msg)
+	if len(cmd.Payload) > p.chunkSize() {
+		return p.publishChunked(cmd)
 	}
-
-	// wait for broker response
-	resp, err := p.ReadResponse()
+	resp, err := p.request(cmd)
 	if err != nil {
 		return err
 	}
+	return checkAck("publish", resp)
+}
+
+// chunkSize returns the largest payload sent in a single frame.
+func (p *Producer) chunkSize() int {
+	if p.Config.ChunkSize > 0 {
+		return p.Config.ChunkSize
+	}
+	return protocol.DefaultChunkSize
+}
+
+// publishChunked sends a large message as a sequence of chunks the broker reassembles.
+// a lost connection discards the chunks already sent, so the whole sequence is sent
+// again after reconnecting; the message ID keeps the broker from publishing it twice.
+func (p *Producer) publishChunked(cmd *protocol.Command) error {
+	var err error
+	for attempt := 0; attempt <= p.Config.RetryMax; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying chunked PUBLISH of message %s (try %d/%d): %v", cmd.MessageID, attempt, p.Config.RetryMax, err)
+			p.Disconnect()
+			if err = p.Connect(p.Address); err != nil {
+				continue
+			}
+		}
+		var resp *protocol.Command
+		if resp, err = p.sendChunks(cmd); err == nil {
+			return checkAck("publish", resp)
+		}
+	}
+	return err
+}
+
+// sendChunks sends the payload of cmd in chunks, waiting for each ACK, and returns
+// the response to the last chunk or to the first one the broker rejected.
+func (p *Producer) sendChunks(cmd *protocol.Command) (*protocol.Command, error) {
+	size := p.chunkSize()
+	count := (len(cmd.Payload) + size - 1) / size
+	for i := 0; i < count; i++ {
+		headers := make(map[string]string, len(cmd.Headers)+2)
+		for k, v := range cmd.Headers {
+			headers[k] = v
+		}
+		headers[protocol.HeaderChunkIndex] = strconv.Itoa(i)
+		headers[protocol.HeaderChunkCount] = strconv.Itoa(count)
+		chunk := &protocol.Command{
+			Type:      protocol.PUBLISH,
+			Topic:     cmd.Topic,
+			MessageID: cmd.MessageID,
+			Headers:   headers,
+			Payload:   cmd.Payload[i*size : min((i+1)*size, len(cmd.Payload))],
+		}
+
+		if err := p.SendCommand(chunk); err != nil {
+			return nil, err
+		}
+		resp, err := p.ReadResponse()
+		if err != nil {
+			return nil, err
+		}
+		if i == count-1 || resp.Type != protocol.ACK || len(resp.Payload) > 0 {
+			return resp, nil
+		}
+	}
+	return nil, errors.New("empty chunked message")
+}
+
+// publishCommand builds the PUBLISH command for msg, assigning its ID if it has none.
+func (p *Producer) publishCommand(msg *types.Message) *protocol.Command {
+	if msg.ID == "" {
+		msg.ID = p.nextMessageID()
+	}
+	headers := make(map[string]string, len(msg.Headers)+5)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if msg.Priority != 0 {
+		headers[protocol.HeaderPriority] = strconv.Itoa(msg.Priority)
+	}
+	if msg.Key != "" {
+		headers[protocol.HeaderKey] = msg.Key
+	}
+	if msg.Retain {
+		headers[protocol.HeaderRetain] = "true"
+	}
+	if msg.ReplyTo != "" {
+		headers[protocol.HeaderReplyTo] = msg.ReplyTo
+	}
+	if msg.CorrelationID != "" {
+		headers[protocol.HeaderCorrelationID] = msg.CorrelationID
+	}
+	return &protocol.Command{
+		Type:      protocol.PUBLISH,
+		Topic:     msg.Topic,
+		MessageID: msg.ID,
+		Headers:   headers,
+		Payload:   msg.Payload,
+	}
+}
+
+// checkAck turns the broker response to op into an error unless it is a plain ACK.
+func checkAck(op string, resp *protocol.Command) error {
 	if resp.Type != protocol.ACK {
-		return fmt.Errorf("publish failed, got type %s", resp.Type)
+		return fmt.Errorf("%s failed, got type %s", op, resp.Type)
+	}
+	if len(resp.Payload) > 0 {
+		return fmt.Errorf("%s failed: %s", op, resp.Payload)
 	}
 	return nil
 }
 
-// PublishBatch sends multiple messages together (simplified)
+// PublishRetained publishes payload and keeps it as the topic's last value,
+// delivered first to every new subscriber.
+func (p *Producer) PublishRetained(topic string, payload []byte) error {
+	return p.PublishMessage(&types.Message{Topic: topic, Payload: payload, Retain: true})
+}
+
+// ClearRetained removes the retained value of topic.
+func (p *Producer) ClearRetained(topic string) error {
+	return p.PublishMessage(&types.Message{Topic: topic, Payload: []byte{}, Retain: true})
+}
+
+// request sends cmd and waits for the broker response. on network errors it
+// reconnects and sends the same command again, up to Config.RetryMax times.
+func (p *Producer) request(cmd *protocol.Command) (*protocol.Command, error) {
+	var err error
+	for attempt := 0; attempt <= p.Config.RetryMax; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying %s of message %s (try %d/%d): %v", cmd.Type, cmd.MessageID, attempt, p.Config.RetryMax, err)
+			p.Disconnect()
+			if err = p.Connect(p.Address); err != nil {
+				continue
+			}
+		}
+
+		// send the command over TCP connection
+		if err = p.SendCommand(cmd); err != nil {
+			continue
+		}
+
+		// wait for broker response
+		var resp *protocol.Command
+		if resp, err = p.ReadResponse(); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// PublishBatch sends payloads to topic in a single round trip and returns
+// the first error reported for one of them.
 func (p *Producer) PublishBatch(topic string, payloads [][]byte) error {
-	for _, payload := range payloads {
-		if err := p.Publish(topic, payload); err != nil {
+	msgs := make([]*types.Message, len(payloads))
+	for i, payload := range payloads {
+		msgs[i] = &types.Message{Topic: topic, Payload: payload}
+	}
+	errs, err := p.PublishMessages(msgs)
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// PublishMessages sends msgs, possibly to different topics, in one BATCH frame and
+// returns the outcome of each message, in order. err is set when the batch as a
+// whole failed. a retried batch is deduplicated message by message like PublishMessage.
+// messages are not split into chunks, so the batch must fit in one frame.
+func (p *Producer) PublishMessages(msgs []*types.Message) (errs []error, err error) {
+	cmds := make([]*protocol.Command, len(msgs))
+	for i, msg := range msgs {
+		cmds[i] = p.publishCommand(msg)
+	}
+	payload, err := protocol.EncodeBatch(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.request(&protocol.Command{Type: protocol.BATCH, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := resp.Headers[protocol.HeaderResults]; !ok {
+		return nil, checkAck("batch", resp)
+	}
+	acks, err := protocol.DecodeBatch(resp.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(acks) != len(msgs) {
+		return nil, fmt.Errorf("batch failed: %d results for %d messages", len(acks), len(msgs))
+	}
+	errs = make([]error, len(acks))
+	for i, ack := range acks {
+		errs[i] = checkAck("publish", ack)
+	}
+	return errs, nil
+}
+
 // PublishAsync sends a message asynchronously with callback.
 func (p *Producer) PublishAsync(topic string, payload []byte, callback func(error)) {
 	go func() {
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"testing"
+
+	"queuego/internal/protocol"
+	"queuego/pkg/types"
+)
+
+func TestPublishCommandHeaders(t *testing.T) {
+	p := NewProducer(ClientConfig{})
+	cmd := p.publishCommand(&types.Message{
+		Topic:         "orders",
+		Payload:       []byte("x"),
+		Headers:       map[string]string{"region": "eu"},
+		Priority:      3,
+		Key:           "order-1",
+		Retain:        true,
+		ReplyTo:       "_inbox.abc",
+		CorrelationID: "req-1",
+	})
+	want := map[string]string{
+		"region":                     "eu",
+		protocol.HeaderPriority:      "3",
+		protocol.HeaderKey:           "order-1",
+		protocol.HeaderRetain:        "true",
+		protocol.HeaderReplyTo:       "_inbox.abc",
+		protocol.HeaderCorrelationID: "req-1",
+	}
+	if len(cmd.Headers) != len(want) {
+		t.Fatalf("headers %v, want %v", cmd.Headers, want)
+	}
+	for k, v := range want {
+		if cmd.Headers[k] != v {
+			t.Errorf("header %s = %q, want %q", k, cmd.Headers[k], v)
+		}
+	}
+	if cmd.MessageID == "" {
+		t.Error("message ID not assigned")
+	}
+}
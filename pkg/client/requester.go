@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"queuego/internal/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Requester sends requests and waits for their replies on a temporary inbox
+// the broker creates for the connection and removes when it closes.
+type Requester struct {
+	*Client
+	Inbox string // reply topic, set by Connect
+
+	prefix  string                            // of request IDs, which double as correlation IDs
+	seq     atomic.Uint64                     // last request number
+	pending map[string]chan *protocol.Command // correlation ID -> waiting request
+	pmu     sync.Mutex
+}
+
+func NewRequester(cfg ClientConfig) *Requester {
+	return &Requester{
+		Client: &Client{
+			Config: cfg,
+			active: false,
+		},
+		prefix:  newProducerID(),
+		pending: make(map[string]chan *protocol.Command),
+	}
+}
+
+// Connect connects to the broker, opens the connection's inbox and starts reading replies.
+func (r *Requester) Connect(address string) error {
+	if err := r.Client.Connect(address); err != nil {
+		return err
+	}
+	if err := r.SendCommand(&protocol.Command{Type: protocol.INBOX}); err != nil {
+		return err
+	}
+	resp, err := r.ReadResponse()
+	if err != nil {
+		return err
+	}
+	if resp.Type != protocol.ACK || len(resp.Payload) > 0 || resp.Topic == "" {
+		return fmt.Errorf("opening inbox failed: %s", resp.Payload)
+	}
+	r.Inbox = resp.Topic
+
+	go r.readLoop()
+	return nil
+}
+
+// Request publishes payload to topic with the inbox as reply-to and waits for the
+// matching reply until ctx is done.
+func (r *Requester) Request(ctx context.Context, topic string, payload []byte) (*protocol.Command, error) {
+	if r.Inbox == "" {
+		return nil, errors.New("requester is not connected")
+	}
+	id := r.prefix + "-" + strconv.FormatUint(r.seq.Add(1), 10)
+	replies := make(chan *protocol.Command, 2)
+	r.pmu.Lock()
+	r.pending[id] = replies
+	r.pmu.Unlock()
+	defer func() {
+		r.pmu.Lock()
+		delete(r.pending, id)
+		r.pmu.Unlock()
+	}()
+
+	err := r.SendCommand(&protocol.Command{
+		Type:      protocol.PUBLISH,
+		Topic:     topic,
+		MessageID: id,
+		Headers: map[string]string{
+			protocol.HeaderReplyTo:       r.Inbox,
+			protocol.HeaderCorrelationID: id,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case resp := <-replies:
+			if resp.Type == protocol.ACK {
+				// the broker's answer to the publish itself
+				if len(resp.Payload) > 0 {
+					return nil, fmt.Errorf("request failed: %s", resp.Payload)
+				}
+				continue
+			}
+			return resp, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// readLoop routes publish ACKs and inbox deliveries to the waiting requests
+// until reading fails, which Disconnect causes by closing the connection.
+func (r *Requester) readLoop() {
+	chunks := make(deliveryChunks)
+	for {
+		msg, err := r.ReadResponse()
+		if err != nil {
+			if r.connected() {
+				log.Printf("requester read failed: %v", err)
+			}
+			return
+		}
+
+		id := msg.MessageID
+		if msg.Type == protocol.DELIVER {
+			if msg = chunks.add(msg); msg == nil {
+				continue
+			}
+			id = msg.Headers[protocol.HeaderCorrelationID]
+			_ = r.SendCommand(&protocol.Command{
+				Type:      protocol.ACK,
+				Topic:     msg.Topic,
+				MessageID: msg.MessageID,
+			})
+		} else if msg.Type != protocol.ACK {
+			continue
+		}
+
+		r.pmu.Lock()
+		replies, ok := r.pending[id]
+		r.pmu.Unlock()
+		if !ok {
+			if msg.Type == protocol.DELIVER {
+				log.Printf("dropping reply %s with no waiting request", id)
+			}
+			continue
+		}
+		select {
+		case replies <- msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"queuego/internal/broker"
+	"queuego/internal/protocol"
+	"queuego/internal/server"
+)
+
+// startServer runs a broker and its TCP server on a free local port and returns the address.
+func startServer(t *testing.T) string {
+	t.Helper()
+	return startServerWith(t, server.ConnectionConfig{})
+}
+
+// startServerWith is startServer with the given connection settings.
+func startServerWith(t *testing.T, cfg server.ConnectionConfig) string {
+	t.Helper()
+	br := broker.NewBroker(broker.BrokerConfig{
+		MaxQueueSize:       100,
+		CleanupInterval:    time.Minute,
+		AckTimeout:         time.Minute,
+		RedeliveryInterval: time.Minute,
+	})
+	br.Start()
+	srv, err := server.NewServer("127.0.0.1:0", br, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(func() {
+		srv.Stop()
+		br.Stop()
+	})
+	return srv.Listener.Addr().String()
+}
+
+func TestRequestReplyThenDisconnect(t *testing.T) {
+	addr := startServer(t)
+	cfg := ClientConfig{RetryMax: 1, RetryInterval: time.Second, ConnTimeout: time.Second}
+
+	svc := NewConsumer(cfg)
+	if err := svc.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Disconnect()
+	err := svc.Subscribe("upper", func(m *protocol.Command) {
+		svc.Reply(m, []byte(strings.ToUpper(string(m.Payload))))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	r := NewRequester(cfg)
+	if err := r.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := r.Request(ctx, "upper", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Payload) != "HELLO" {
+		t.Fatalf("reply %q, want HELLO", resp.Payload)
+	}
+
+	// the read loop stops on the closed connection, racing nothing
+	if err := r.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"queuego/internal/protocol"
+	"queuego/pkg/types"
+)
+
+// Transaction publishes messages to one or more topics atomically. the broker stages
+// them until Commit, and discards them on Abort or when the connection drops.
+// the producer must not be used for anything else until the transaction ends.
+type Transaction struct {
+	p    *Producer
+	done bool
+}
+
+// Begin starts a transaction on the producer's connection.
+func (p *Producer) Begin() (*Transaction, error) {
+	resp, err := p.request(&protocol.Command{Type: protocol.BEGIN})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAck("begin", resp); err != nil {
+		return nil, err
+	}
+	return &Transaction{p: p}, nil
+}
+
+// Publish stages payload for topic.
+func (tx *Transaction) Publish(topic string, payload []byte) error {
+	return tx.PublishMessage(&types.Message{Topic: topic, Payload: payload})
+}
+
+// PublishMessage stages a fully described message. delayed delivery is not
+// supported within a transaction.
+func (tx *Transaction) PublishMessage(msg *types.Message) error {
+	cmd := tx.p.publishCommand(msg)
+	if len(cmd.Payload) > tx.p.chunkSize() {
+		return tx.exchange("publish", func() (*protocol.Command, error) {
+			return tx.p.sendChunks(cmd)
+		})
+	}
+	return tx.send("publish", cmd)
+}
+
+// Commit publishes every staged message together. a message ID the broker has seen
+// within the topic's dedup window fails the whole commit with an error naming it,
+// and nothing is published; outside a transaction Publish reports such a duplicate
+// as a success instead. so if Commit fails with a connection error the outcome is
+// unknown, and committing the same messages again fails as a duplicate when the
+// first attempt went through, as long as the topics deduplicate message IDs.
+func (tx *Transaction) Commit() error {
+	err := tx.send("commit", &protocol.Command{Type: protocol.COMMIT})
+	tx.done = true
+	return err
+}
+
+// Abort discards the staged messages.
+func (tx *Transaction) Abort() error {
+	err := tx.send("abort", &protocol.Command{Type: protocol.ABORT})
+	tx.done = true
+	return err
+}
+
+// send runs one request of the transaction. unlike Producer.request it never
+// reconnects: the staged messages live on the connection and a new one would
+// publish the rest of the transaction outside of it.
+func (tx *Transaction) send(op string, cmd *protocol.Command) error {
+	return tx.exchange(op, func() (*protocol.Command, error) {
+		if err := tx.p.SendCommand(cmd); err != nil {
+			return nil, err
+		}
+		return tx.p.ReadResponse()
+	})
+}
+
+// exchange runs roundTrip once and checks the broker response. a connection error
+// ends the transaction.
+func (tx *Transaction) exchange(op string, roundTrip func() (*protocol.Command, error)) error {
+	if tx.done {
+		return errors.New("transaction already ended")
+	}
+	resp, err := roundTrip()
+	if err != nil {
+		tx.done = true
+		return fmt.Errorf("%s failed, transaction lost with the connection: %w", op, err)
+	}
+	return checkAck(op, resp)
+}
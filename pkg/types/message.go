@@ -5,6 +5,16 @@ import (
 	"time"
 )
 
+// headers stamped by the broker on dead-lettered messages.
+const (
+	HeaderOriginalTopic = "x-original-topic"
+	HeaderDeliveryCount = "x-delivery-count"
+	HeaderLastError     = "x-last-error"
+)
+
+// HeaderDeliverAt holds the RFC 3339 time a scheduled message becomes visible.
+const HeaderDeliverAt = "deliver-at"
+
 // message represents a generic message structure.
 type Message struct {
 	ID        string            // UUID or unique identifier
@@ -13,6 +23,14 @@ type Message struct {
 	Timestamp time.Time         // message creation time
 	Headers   map[string]string // optional metadata
 	Priority  int               // message priority (higher = more priority)
+	ExpiresAt time.Time         // zero = never expires
+	Key       string            // messages with the same key keep their order
+	Partition int               // topic partition the message was assigned to
+	Offset    int64             // position in a log topic, assigned on publish
+	Retain    bool              // kept as the topic's last value for new subscribers
+
+	ReplyTo       string // topic the receiver should reply to, usually a requester's inbox
+	CorrelationID string // copied onto the reply so the requester can match it
 }
 
 // NewMessage creates a new Message with the current timestamp.
@@ -27,6 +45,11 @@ func NewMessage(id, topic string, payload []byte, headers map[string]string, pri
 	}
 }
 
+// IsExpired reports whether the message passed its expiry time.
+func (m *Message) IsExpired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
 // validate checks whether the message is valid
 func (m *Message) Validate() error {
 	if m == nil {